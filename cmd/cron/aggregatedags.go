@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/md5"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -48,6 +49,8 @@ var targetMinSizeSoft, targetMinSizeHard uint64
 var concurrentExports, settleDelayHours, forceAgeHours uint
 var captureAggregateCandidatesSnapshot bool
 var carExportDir string
+var exportHeadroom uint64
+var exportGuard *exportCapacityGuard
 
 type pendingDag struct {
 	aggentry  dagaggregator.AggregateDagEntry
@@ -66,10 +69,30 @@ type aggregateResult struct {
 	carMd5            []byte
 }
 
+type aggregateMetadata struct {
+	dagaggregator.ManifestPreamble
+	Timeboxed bool   `json:"timeboxed,omitempty"`
+	Sha256sum string `json:"sha256hex"`
+	Md5sum    string `json:"md5hex"`
+}
+
+func newAggregateMetadata(res *aggregateResult, isTimeboxed bool) aggregateMetadata {
+	return aggregateMetadata{
+		ManifestPreamble: dagaggregator.ManifestPreamble{
+			RecordType: dagaggregator.RecordType(aggregateType),
+			Version:    dagaggregator.CurrentManifestPreamble.Version,
+		},
+		Timeboxed: isTimeboxed,
+		Sha256sum: fmt.Sprintf("%x", res.carSha256),
+		Md5sum:    fmt.Sprintf("%x", res.carMd5),
+	}
+}
+
 type runningTotals struct {
 	newAggregatesTotal       *uint64
 	dagsAggregatedStandalone *uint64
 	dagsAggregatedTotal      *uint64
+	bundlesSkippedNoSpace    *uint64
 }
 
 var aggregateDags = &cli.Command{
@@ -112,6 +135,17 @@ var aggregateDags = &cli.Command{
 			Value:       12,
 			Destination: &forceAgeHours,
 		},
+		&cli.Uint64Flag{
+			Name:        "export-dir-headroom",
+			Usage:       "Amount of bytes to always leave free in export-dir, on top of what in-flight exports are projected to still write",
+			Value:       16 << 30,
+			Destination: &exportHeadroom,
+		},
+		&cli.StringFlag{
+			Name:  "on-insufficient-space",
+			Usage: "One of 'wait' (for in-flight exports to finish) or 'skip' (the bundle until next run)",
+			Value: "wait",
+		},
 		&cli.BoolFlag{
 			Name:  "skip-pinning",
 			Usage: "do not pin resulting aggregates - rely on out-of-band advertisers",
@@ -140,6 +174,16 @@ var aggregateDags = &cli.Command{
 			return xerrors.Errorf("check of '%s' failed: %w", carExportDir, err)
 		}
 
+		switch cctx.String("on-insufficient-space") {
+		case "wait", "skip":
+			exportGuard = newExportCapacityGuard(carExportDir, exportHeadroom, cctx.String("on-insufficient-space") == "wait")
+		default:
+			return xerrors.Errorf("unknown on-insufficient-space value '%s'", cctx.String("on-insufficient-space"))
+		}
+		if _, err := exportGuard.freeBytes(); err != nil {
+			return err
+		}
+
 		ctx, closer := context.WithCancel(cctx.Context)
 		defer closer()
 
@@ -162,9 +206,11 @@ var aggregateDags = &cli.Command{
 			newAggregatesTotal:       new(uint64),
 			dagsAggregatedStandalone: new(uint64),
 			dagsAggregatedTotal:      new(uint64),
+			bundlesSkippedNoSpace:    new(uint64),
 		}
 		var lastRoundAgg []dagaggregator.AggregateDagEntry
 		defer func() {
+			exportDirFree, exportReservedPeak := exportGuard.stats()
 			log.Infow("summary",
 				"initialCandidates", standaloneCandidateCount,
 				"uniqueCandidateSources", dagSourcesCount,
@@ -172,6 +218,14 @@ var aggregateDags = &cli.Command{
 				"aggregatesAssembled", *stats.newAggregatesTotal,
 				"dagsAggregatedStandalone", *stats.dagsAggregatedStandalone,
 				"dagsAggregatedTotal", *stats.dagsAggregatedTotal,
+				"bundlesSkippedInsufficientSpace", *stats.bundlesSkippedNoSpace,
+				"exportDirFreeBytes", exportDirFree,
+				"exportReservedPeakBytes", exportReservedPeak,
+			)
+			runMetrics = append(runMetrics,
+				newRunGauge("export_dir_free_bytes", "Free bytes in export-dir as of the last capacity check", float64(exportDirFree)),
+				newRunGauge("export_reserved_peak_bytes", "Highest amount of bytes reserved by concurrent in-flight exports", float64(exportReservedPeak)),
+				newRunGauge("bundles_skipped_insufficient_space", "Amount of aggregate bundles not exported due to insufficient export-dir space", float64(*stats.bundlesSkippedNoSpace)),
 			)
 		}()
 
@@ -380,8 +434,8 @@ var aggregateDags = &cli.Command{
 							d.size_actual
 						FROM cargo.aggregate_entries ae
 						JOIN cargo.dags d USING ( cid_v1 )
-						LEFT JOIN cargo.deals de -- this inflates the replica_count, conflating 0 with 1 ( always 1 ), which is ok
-							ON de.aggregate_cid = ae.aggregate_cid AND de.status != 'terminated'
+						LEFT JOIN cargo.own_deals de -- this inflates the replica_count, conflating 0 with 1 ( always 1 ), which is ok
+							ON de.aggregate_cid = ae.aggregate_cid AND de.status NOT IN ( 'terminated', 'expired', 'slashed', 'invalid' )
 					WHERE
 						-- don't go with big dags, don't risk it
 						d.size_actual > 0 AND d.size_actual < $1
@@ -679,7 +733,11 @@ func reifyAggregateCars(cctx *cli.Context, stats runningTotals, timeboxingActive
 						return
 					}
 					res, err := aggregateAndAnalyze(cctx, carExportDir, toAgg, timeboxingActive)
-					if err != nil {
+					if errors.Is(err, errInsufficientExportSpace) {
+						log.Warnf("skipping bundle of %d standalone dags: %s", len(toAgg), err)
+						atomic.AddUint64(stats.bundlesSkippedNoSpace, 1)
+						continue
+					} else if err != nil {
 						errCh <- err
 						ctxCloser()
 						return
@@ -816,21 +874,16 @@ func aggregateAndAnalyze(cctx *cli.Context, outDir string, toAgg []dagaggregator
 		humanize.Comma(projectedSize),
 	)
 
-	carTmpFile, realFile, err := tmpfile.TempFile(outDir)
-	if err != nil {
-		return nil, err
-	}
-	defer carTmpFile.Close() //nolint:errcheck
-	if realFile {
-		os.Remove(carTmpFile.Name()) //nolint:errcheck
-		return nil, xerrors.New("TempFile() did not create an anonymous temp file as expected")
+	var progress io.Writer
+	if exportGuard != nil {
+		resv, err := exportGuard.reserve(ctx, uint64(projectedSize))
+		if err != nil {
+			return nil, xerrors.Errorf("%s: %w", aggLabel, err)
+		}
+		defer resv.release()
+		progress = resv
 	}
 
-	workerCount := 3
-
-	doneCh := make(chan struct{}, workerCount) // this effectively emulates a sync.WaitGroup
-	errCh := make(chan error, 1+1+2)           // exporter has defers
-
 	api := ipfsAPI(cctx)
 	api.SetTimeout(16 * time.Hour) // yes, obscene, but plausible: bafybeifg2u5gedbeo2fio24fpy7sozsxyppdo4h2tvdvvax2p3nxmb6hpu took 14h :cryingbear:
 
@@ -849,6 +902,171 @@ func aggregateAndAnalyze(cctx *cli.Context, outDir string, toAgg []dagaggregator
 		}()
 	}
 
+	carTmpFile, err := exportCarFile(cctx, api, outDir, res, !cctx.Bool("skip-pinning"), progress)
+	if err != nil {
+		return nil, err
+	}
+	defer carTmpFile.Close() //nolint:errcheck
+
+	// if it is too small - don't save it
+	if res.carSize < targetMinSizeHard {
+		log.Warnf("%s: UNDERSIZED car is only %s bytes (%.2f%% of projected), under a minimum of %s",
+			aggLabel,
+			humanize.Comma(int64(res.carSize)),
+			float64(100*res.carSize)/float64(projectedSize),
+			humanize.Comma(int64(targetMinSizeHard)),
+		)
+		return res, nil
+	}
+
+	//
+	// whoa - everything worked!!!
+	log.Infof("%s: persisting records in database", aggLabel)
+
+	aggMeta, err := json.Marshal(newAggregateMetadata(res, isTimeboxed))
+	if err != nil {
+		return nil, err
+	}
+	root := res.carRoot.String()
+
+	tx, err := cargoDb.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err == nil {
+			err = ctx.Err()
+		}
+		if err != nil && tx != nil {
+			tx.Rollback(context.Background()) //nolint:errcheck
+		}
+	}()
+
+	_, err = tx.Exec(ctx, fmt.Sprintf(`SET LOCAL statement_timeout = %d`, (2*time.Hour).Milliseconds()))
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = tx.Exec(
+		ctx,
+		`
+		INSERT INTO cargo.aggregates ( "aggregate_cid", "piece_cid", "export_size", "piece_size", "metadata" )
+			VALUES ( $1, $2, $3, $4, $5 )
+		ON CONFLICT DO NOTHING
+		`,
+		root,
+		res.carCommp.String(),
+		res.carSize,
+		res.carPieceSize,
+		aggMeta,
+	); err != nil {
+		return nil, err
+	}
+
+	sourcesToUnpin := make(chan string, len(res.manifestEntries))
+	links := make([][]interface{}, 0, len(res.manifestEntries))
+	for _, e := range res.manifestEntries {
+		sourcesToUnpin <- e.DagCidV1
+		links = append(links, []interface{}{
+			root,
+			e.DagCidV1,
+			manifestEntrySelector(e),
+		})
+	}
+	close(sourcesToUnpin)
+	if _, err = tx.CopyFrom(
+		ctx,
+		pgx.Identifier{"cargo", "aggregate_entries"},
+		[]string{"aggregate_cid", "cid_v1", "datamodel_selector"},
+		pgx.CopyFromRows(links),
+	); err != nil {
+		return nil, err
+	}
+
+	// the sidecar goes in place before anything is committed: once the car is
+	// offloaded there is nothing left locally to regenerate it from
+	manifestFn, err := writeManifestSidecar(outDir, res, isTimeboxed)
+	if err != nil {
+		return nil, xerrors.Errorf("%s: failed writing manifest sidecar: %w", aggLabel, err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		os.Remove(manifestFn) //nolint:errcheck
+		return nil, err
+	}
+
+	// disarm defers higher up
+	toUnpinOnError = ""
+	tx = nil
+
+	// all done: reify file
+	fn, err := reifyCarFile(carTmpFile, outDir, res)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("%s: successfully recorded and reified %s bytes (%.2f%% of projected) at %s",
+		aggLabel,
+		humanize.Comma(int64(res.carSize)),
+		float64(100*res.carSize)/float64(projectedSize),
+		fn,
+	)
+
+	if cctx.Bool("unpin-sources") {
+		log.Infof("unpinning %d source dags", len(sourcesToUnpin))
+		workerCount := len(sourcesToUnpin)
+		if cfgMax := cctx.Int("ipfs-api-max-workers"); workerCount > cfgMax {
+			workerCount = cfgMax
+		}
+		var wg sync.WaitGroup
+		for workerCount > 0 {
+			workerCount--
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					cidStr, chanOpen := <-sourcesToUnpin
+					if !chanOpen {
+						return
+					}
+					// nearly everything would have been unpinned already, so no error checks
+					// sadly this is somewhat slow, but oh well... better be extra proactive
+					api.Request("pin/rm").Arguments(cidStr).Option("offline", true).Exec(ctx, nil) //nolint:errcheck
+				}
+			}()
+		}
+		wg.Wait()
+	}
+
+	return res, nil
+}
+
+// exportCarFile streams the dag rooted at res.carRoot from the ipfs daemon into
+// an anonymous tempfile within outDir, populating the size and hash fields of res.
+// If progress is not nil it observes every byte written.
+func exportCarFile(cctx *cli.Context, api *ipfsapi.Shell, outDir string, res *aggregateResult, pin bool, progress io.Writer) (_ *os.File, err error) {
+	ctx, ctxCloser := context.WithCancel(cctx.Context)
+	defer ctxCloser()
+
+	carTmpFile, realFile, err := tmpfile.TempFile(outDir)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			carTmpFile.Close() //nolint:errcheck
+		}
+	}()
+	if realFile {
+		os.Remove(carTmpFile.Name()) //nolint:errcheck
+		return nil, xerrors.New("TempFile() did not create an anonymous temp file as expected")
+	}
+
+	workerCount := 3
+
+	doneCh := make(chan struct{}, workerCount) // this effectively emulates a sync.WaitGroup
+	errCh := make(chan error, 1+1+2)           // exporter has defers
+
 	//
 	// async ref-walker ( this speeds up things considerably )
 	// we do not use the results in any way, this just ensures we are pulling things with fanout as fast as we can
@@ -872,7 +1090,7 @@ func aggregateAndAnalyze(cctx *cli.Context, outDir string, toAgg []dagaggregator
 	go func() {
 		defer func() { doneCh <- struct{}{} }()
 
-		if cctx.Bool("skip-pinning") {
+		if !pin {
 			return
 		}
 
@@ -908,8 +1126,12 @@ func aggregateAndAnalyze(cctx *cli.Context, outDir string, toAgg []dagaggregator
 			cp := new(commp.Calc)
 			sha := sha256simd.New()
 			md5 := md5.New()
+			sinks := []io.Writer{carTmpFile, cp, sha, md5}
+			if progress != nil {
+				sinks = append(sinks, progress)
+			}
 			sz, err := io.CopyBuffer(
-				io.MultiWriter(carTmpFile, cp, sha, md5),
+				io.MultiWriter(sinks...),
 				apiresp.Output,
 				make([]byte, 32<<20),
 			)
@@ -978,146 +1200,18 @@ watchdog:
 		return nil, err
 	}
 
-	// if it is too small - don't save it
-	if res.carSize < targetMinSizeHard {
-		log.Warnf("%s: UNDERSIZED car is only %s bytes (%.2f%% of projected), under a minimum of %s",
-			aggLabel,
-			humanize.Comma(int64(res.carSize)),
-			float64(100*res.carSize)/float64(projectedSize),
-			humanize.Comma(int64(targetMinSizeHard)),
-		)
-		return res, nil
-	}
-
-	//
-	// whoa - everything worked!!!
-	log.Infof("%s: persisting records in database", aggLabel)
-
-	type aggregateMetadata struct {
-		dagaggregator.ManifestPreamble
-		Timeboxed bool   `json:"timeboxed,omitempty"`
-		Sha256sum string `json:"sha256hex"`
-		Md5sum    string `json:"md5hex"`
-	}
-
-	aggMeta, err := json.Marshal(aggregateMetadata{
-		ManifestPreamble: dagaggregator.ManifestPreamble{
-			RecordType: dagaggregator.RecordType(aggregateType),
-			Version:    dagaggregator.CurrentManifestPreamble.Version,
-		},
-		Timeboxed: isTimeboxed,
-		Sha256sum: fmt.Sprintf("%x", res.carSha256),
-		Md5sum:    fmt.Sprintf("%x", res.carMd5),
-	})
-	if err != nil {
-		return nil, err
-	}
-	root := res.carRoot.String()
-
-	tx, err := cargoDb.Begin(ctx)
-	if err != nil {
-		return nil, err
-	}
-	defer func() {
-		if err == nil {
-			err = ctx.Err()
-		}
-		if err != nil && tx != nil {
-			tx.Rollback(context.Background()) //nolint:errcheck
-		}
-	}()
-
-	_, err = tx.Exec(ctx, fmt.Sprintf(`SET LOCAL statement_timeout = %d`, (2*time.Hour).Milliseconds()))
-	if err != nil {
-		return nil, err
-	}
-
-	if _, err = tx.Exec(
-		ctx,
-		`
-		INSERT INTO cargo.aggregates ( "aggregate_cid", "piece_cid", "export_size", "metadata" )
-			VALUES ( $1, $2, $3, $4 )
-		ON CONFLICT DO NOTHING
-		`,
-		root,
-		res.carCommp.String(),
-		res.carSize,
-		aggMeta,
-	); err != nil {
-		return nil, err
-	}
-
-	sourcesToUnpin := make(chan string, len(res.manifestEntries))
-	links := make([][]interface{}, 0, len(res.manifestEntries))
-	for _, e := range res.manifestEntries {
-		sourcesToUnpin <- e.DagCidV1
-		links = append(links, []interface{}{
-			root,
-			e.DagCidV1,
-			fmt.Sprintf("Links/%d/Hash/Links/%d/Hash/Links/%d/Hash", e.PathIndexes[0], e.PathIndexes[1], e.PathIndexes[2]),
-		})
-	}
-	close(sourcesToUnpin)
-	if _, err = tx.CopyFrom(
-		ctx,
-		pgx.Identifier{"cargo", "aggregate_entries"},
-		[]string{"aggregate_cid", "cid_v1", "datamodel_selector"},
-		pgx.CopyFromRows(links),
-	); err != nil {
-		return nil, err
-	}
-
-	if err = tx.Commit(ctx); err != nil {
-		return nil, err
-	}
-
-	// disarm defers higher up
-	toUnpinOnError = ""
-	tx = nil
+	return carTmpFile, nil
+}
 
-	// all done: reify file
-	fn := fmt.Sprintf("%s/%x_%s.car", outDir, res.carMd5, res.carCommp.String())
-	err = tmpfile.Link(carTmpFile, fn) // likelihood of failure here is nonexistent
-	if err != nil {
-		return nil, err
+// reifyCarFile links a fully exported anonymous tempfile into outDir under its final name
+func reifyCarFile(carTmpFile *os.File, outDir string, res *aggregateResult) (string, error) {
+	fn := fmt.Sprintf("%s/%s", outDir, aggregateCarName(fmt.Sprintf("%x", res.carMd5), res.carCommp.String()))
+	if err := tmpfile.Link(carTmpFile, fn); err != nil { // likelihood of failure here is nonexistent
+		return "", err
 	}
 
 	os.Chmod(fn, unixReadable) //nolint:errcheck
-
-	log.Infof("%s: successfully recorded and reified %s bytes (%.2f%% of projected) at %s",
-		aggLabel,
-		humanize.Comma(int64(res.carSize)),
-		float64(100*res.carSize)/float64(projectedSize),
-		fn,
-	)
-
-	if cctx.Bool("unpin-sources") {
-		log.Infof("unpinning %d source dags", len(sourcesToUnpin))
-		workerCount := len(sourcesToUnpin)
-		if cfgMax := cctx.Int("ipfs-api-max-workers"); workerCount > cfgMax {
-			workerCount = cfgMax
-		}
-		var wg sync.WaitGroup
-		for workerCount > 0 {
-			workerCount--
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				for {
-					cidStr, chanOpen := <-sourcesToUnpin
-					if !chanOpen {
-						return
-					}
-					// nearly everything would have been unpinned already, so no error checks
-					// sadly this is somewhat slow, but oh well... better be extra proactive
-					api.Request("pin/rm").Arguments(cidStr).Option("offline", true).Exec(ctx, nil) //nolint:errcheck
-				}
-			}()
-		}
-		wg.Wait()
-	}
-
-	return res, nil
+	return fn, nil
 }
 
 // pulls cids from an AllKeysChan and sends them concurrently via multiple workers to an API
@@ -12,7 +12,6 @@ import (
 
 	"github.com/dustin/go-humanize"
 	"github.com/ipfs/go-cid"
-	ipfsapi "github.com/ipfs/go-ipfs-api"
 	"github.com/jackc/pgx/v4"
 	"github.com/urfave/cli/v2"
 	"golang.org/x/sys/unix"
@@ -42,19 +41,10 @@ var analyzeDags = &cli.Command{
 		cctx.Context, ctxCloser = context.WithCancel(cctx.Context)
 		defer ctxCloser()
 
-		var res struct{ Keys map[string]ipfsapi.PinInfo }
-		if err = ipfsAPI(cctx).Request("pin/ls").Option("type", "recursive").Option("quiet", "true").Exec(cctx.Context, &res); err != nil {
+		systemPins, err := recursivePins(cctx)
+		if err != nil {
 			return err
 		}
-		systemPins := make(map[cid.Cid]struct{}, len(res.Keys))
-		for cidStr := range res.Keys {
-			var c cid.Cid
-			c, err = cid.Parse(cidStr)
-			if err != nil {
-				return err
-			}
-			systemPins[cidv1(c)] = struct{}{}
-		}
 
 		rows, err := cargoDb.Query(
 			cctx.Context,
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+
+	"github.com/dustin/go-humanize"
+	filaddr "github.com/filecoin-project/go-address"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+)
+
+func ownClients(cctx *cli.Context) ([]filaddr.Address, error) {
+	clients := make([]filaddr.Address, 0, len(cctx.StringSlice("own-client")))
+	for _, c := range cctx.StringSlice("own-client") {
+		a, err := filaddr.NewFromString(c)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid own-client address '%s': %w", c, err)
+		}
+		clients = append(clients, a)
+	}
+	return clients, nil
+}
+
+// recordOwnClients refreshes the DataCap of every configured client regardless
+// of whether any deals were seen, appends it to cargo.client_datacap_log, and
+// makes cargo.clients.own reflect the current configuration
+func (run *dealTrackingRun) recordOwnClients(ctx context.Context, clients []filaddr.Address) (map[string]string, error) {
+
+	dataCap := make(map[string]string, len(clients))
+	robustList := make([]string, 0, len(clients))
+
+	for _, c := range clients {
+		robust, err := run.api.StateAccountKey(ctx, c, run.lts.Key())
+		if err != nil {
+			return nil, xerrors.Errorf("resolving client %s failed: %w", c, err)
+		}
+		dc, err := run.api.StateVerifiedClientStatus(ctx, robust, run.lts.Key())
+		if err != nil {
+			return nil, err
+		}
+		available := filabi.NewStoragePower(0)
+		if dc != nil {
+			available = *dc
+		}
+
+		if _, err := cargoDb.Exec(
+			ctx,
+			`
+			INSERT INTO cargo.clients ( client, filp_available, own ) VALUES ( $1, $2, true )
+				ON CONFLICT ( client ) DO UPDATE SET
+					filp_available = EXCLUDED.filp_available,
+					own = true
+			`,
+			robust.String(),
+			available.String(),
+		); err != nil {
+			return nil, err
+		}
+
+		if _, err := cargoDb.Exec(
+			ctx,
+			`
+			INSERT INTO cargo.client_datacap_log ( client, filp_available, epoch ) VALUES ( $1, $2, $3 )
+				ON CONFLICT ( client, epoch ) DO NOTHING
+			`,
+			robust.String(),
+			available.String(),
+			run.lts.Height(),
+		); err != nil {
+			return nil, err
+		}
+
+		run.ownClients[robust] = struct{}{}
+		robustList = append(robustList, robust.String())
+		dataCap[robust.String()] = humanize.BigIBytes(available.Int)
+	}
+
+	_, err := cargoDb.Exec(
+		ctx,
+		`
+		UPDATE cargo.clients SET
+			own = false
+		WHERE own AND NOT client = ANY ( $1::TEXT[] )
+		`,
+		robustList,
+	)
+	return dataCap, err
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	filaddr "github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-bitfield"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/network"
+	filmarket "github.com/filecoin-project/lotus/chain/actors/builtin/market"
+	filtypes "github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	cbg "github.com/whyrusleeping/cbor-gen"
+	"golang.org/x/xerrors"
+)
+
+// Since network version 14 ( actors v6 ) PublishStorageDeals no longer fails as a
+// whole when some proposals are invalid: the return carries a ValidDeals bitfield
+// of proposal indexes, and IDs holds one entry per set bit. Our vendored actors
+// only know the earlier IDs-only shape.
+type publishStorageDealsReturn struct {
+	IDs        []filabi.DealID
+	ValidDeals *bitfield.BitField // nil before network version 14
+}
+
+func decodePublishStorageDealsReturn(raw []byte, nv network.Version) (*publishStorageDealsReturn, error) {
+	br := cbg.GetPeeker(bytes.NewReader(raw))
+	scratch := make([]byte, 8)
+
+	maj, fields, err := cbg.CborReadHeaderBuf(br, scratch)
+	if err != nil {
+		return nil, err
+	}
+	expectedFields := uint64(1)
+	if nv > network.Version13 {
+		expectedFields = 2
+	}
+	if maj != cbg.MajArray || fields != expectedFields {
+		return nil, xerrors.Errorf("unexpected return of %d fields at network version %d", fields, nv)
+	}
+
+	maj, count, err := cbg.CborReadHeaderBuf(br, scratch)
+	if err != nil {
+		return nil, err
+	}
+	if maj != cbg.MajArray {
+		return nil, xerrors.New("deal ids are not an array")
+	}
+	ret := &publishStorageDealsReturn{IDs: make([]filabi.DealID, 0, count)}
+	for i := uint64(0); i < count; i++ {
+		maj, id, err := cbg.CborReadHeaderBuf(br, scratch)
+		if err != nil {
+			return nil, err
+		}
+		if maj != cbg.MajUnsignedInt {
+			return nil, xerrors.Errorf("deal id #%d is not an unsigned int", i)
+		}
+		ret.IDs = append(ret.IDs, filabi.DealID(id))
+	}
+
+	if fields == 2 {
+		ret.ValidDeals = new(bitfield.BitField)
+		if err := ret.ValidDeals.UnmarshalCBOR(br); err != nil {
+			return nil, xerrors.Errorf("decoding valid deals failed: %w", err)
+		}
+	}
+
+	return ret, nil
+}
+
+// dealIDsByProposal maps the index of every proposal that became a deal to its ID
+func (ret *publishStorageDealsReturn) dealIDsByProposal(proposalCount int) (map[int]filabi.DealID, error) {
+	ids := make(map[int]filabi.DealID, len(ret.IDs))
+
+	if ret.ValidDeals == nil {
+		if len(ret.IDs) != proposalCount {
+			return nil, xerrors.Errorf("published %d deals out of %d proposals", len(ret.IDs), proposalCount)
+		}
+		for i, id := range ret.IDs {
+			ids[i] = id
+		}
+		return ids, nil
+	}
+
+	valid, err := ret.ValidDeals.All(uint64(proposalCount))
+	if err != nil {
+		return nil, err
+	}
+	if len(valid) != len(ret.IDs) {
+		return nil, xerrors.Errorf("%d deal ids for %d valid proposals", len(ret.IDs), len(valid))
+	}
+	for i, j := range valid {
+		if j >= uint64(proposalCount) {
+			return nil, xerrors.Errorf("valid proposal index %d out of %d proposals", j, proposalCount)
+		}
+		ids[int(j)] = ret.IDs[i]
+	}
+	return ids, nil
+}
+
+// StateMarketStorageDeal has no structured error for a deal absent from the
+// market actor state: string-match what stmgr.GetStorageDeal returns, which
+// has stayed the same across lotus versions
+func isDealNotFound(err error, dealID int64) bool {
+	return strings.Contains(err.Error(), fmt.Sprintf("deal %d not found", dealID))
+}
+
+// Since network version 22 the market actor emits a deal-published event for
+// every deal, including ones published through a contract or a multisig, which
+// the message walk can not see. Like verifRegAPI these are shapes of a lotus
+// newer than ours, only served on /rpc/v1.
+type actorEventBlock struct {
+	Codec uint64 `json:"codec"`
+	Value []byte `json:"value"`
+}
+
+type actorEventFilter struct {
+	Addresses  []filaddr.Address            `json:"addresses,omitempty"`
+	Fields     map[string][]actorEventBlock `json:"fields,omitempty"`
+	FromHeight *filabi.ChainEpoch           `json:"fromHeight,omitempty"`
+	ToHeight   *filabi.ChainEpoch           `json:"toHeight,omitempty"`
+}
+
+type actorEventEntry struct {
+	Flags uint8
+	Key   string
+	Codec uint64
+	Value []byte
+}
+
+type actorEvent struct {
+	Entries   []actorEventEntry  `json:"entries"`
+	Emitter   filaddr.Address    `json:"emitter"`
+	Reverted  bool               `json:"reverted"`
+	Height    filabi.ChainEpoch  `json:"height"`
+	TipSetKey filtypes.TipSetKey `json:"tipsetKey"`
+	MsgCid    cid.Cid            `json:"msgCid"`
+}
+
+type actorEventsAPI struct {
+	Internal struct {
+		GetActorEventsRaw func(ctx context.Context, filter *actorEventFilter) ([]*actorEvent, error)
+	}
+}
+
+const ipldCborCodec = 0x51
+
+func cborEventBlock(write func(w io.Writer) error) (actorEventBlock, error) {
+	var buf bytes.Buffer
+	if err := write(&buf); err != nil {
+		return actorEventBlock{}, err
+	}
+	return actorEventBlock{Codec: ipldCborCodec, Value: buf.Bytes()}, nil
+}
+
+// publishedDealIDsFromEvents returns the IDs of deals made by our own clients
+// between the two epochs, according to the market actor's deal-published events.
+// executedAt maps inclusion tipsets seen by the message walk to the height of
+// their child, so publications are recorded at the same epoch either way.
+func (run *dealTrackingRun) publishedDealIDsFromEvents(ctx context.Context, from, to filabi.ChainEpoch, executedAt map[filtypes.TipSetKey]filabi.ChainEpoch) ([]int64, error) {
+
+	// no own clients means any client counts: far too many events, the message walk has to do
+	if len(run.ownClients) == 0 {
+		return nil, nil
+	}
+
+	evType, err := cborEventBlock(func(w io.Writer) error {
+		if err := cbg.CborWriteHeader(w, cbg.MajTextString, uint64(len("deal-published"))); err != nil {
+			return err
+		}
+		_, err := io.WriteString(w, "deal-published")
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	filter := &actorEventFilter{
+		Addresses:  []filaddr.Address{filmarket.Address},
+		Fields:     map[string][]actorEventBlock{"$type": {evType}},
+		FromHeight: &from,
+		ToHeight:   &to,
+	}
+	for c := range run.ownClients {
+		idAddr, err := run.api.StateLookupID(ctx, c, run.lts.Key())
+		if err != nil {
+			return nil, xerrors.Errorf("resolving id of client %s failed: %w", c, err)
+		}
+		actorID, err := filaddr.IDFromAddress(idAddr)
+		if err != nil {
+			return nil, err
+		}
+		b, err := cborEventBlock(func(w io.Writer) error { return cbg.CborWriteHeader(w, cbg.MajUnsignedInt, actorID) })
+		if err != nil {
+			return nil, err
+		}
+		filter.Fields["client"] = append(filter.Fields["client"], b)
+	}
+
+	evs, err := run.events.Internal.GetActorEventsRaw(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []int64
+	for _, ev := range evs {
+		if ev.Reverted {
+			continue
+		}
+		for _, e := range ev.Entries {
+			if e.Key != "id" {
+				continue
+			}
+			maj, id, err := cbg.CborReadHeader(bytes.NewReader(e.Value))
+			if err != nil {
+				return nil, xerrors.Errorf("decoding deal id of event from message %s failed: %w", ev.MsgCid, err)
+			}
+			if maj != cbg.MajUnsignedInt {
+				return nil, xerrors.Errorf("deal id of event from message %s is not an unsigned int", ev.MsgCid)
+			}
+
+			ids = append(ids, int64(id))
+			if _, known := run.publications[int64(id)]; !known {
+				epoch, walked := executedAt[ev.TipSetKey]
+				if !walked {
+					epoch = ev.Height + 1
+				}
+				run.publications[int64(id)] = dealPublication{msgCid: ev.MsgCid, epoch: epoch}
+			}
+		}
+	}
+
+	return ids, nil
+}
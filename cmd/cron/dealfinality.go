@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	filprovider "github.com/filecoin-project/lotus/chain/actors/builtin/miner"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+)
+
+// how far along a deal is: an observed transition holds at a later tipset if the
+// deal is at least as far along there
+func dealStatusRank(status string) int {
+	switch status {
+	case "published":
+		return 0
+	case "active":
+		return 1
+	case "expiring":
+		return 2
+	default:
+		return 3
+	}
+}
+
+type tentativeDealEvent struct {
+	entryID    int64
+	dealID     int64
+	status     string
+	latest     bool
+	dealStatus string
+	pieceCid   cid.Cid
+	provider   string
+	startEpoch filabi.ChainEpoch
+	endEpoch   filabi.ChainEpoch
+}
+
+// settleDealEvents re-evaluates every tentative deal event observed at or before
+// the tipset finalityEpochs behind run.lts: events still holding there become
+// final, the rest are reverted, rolling the deal back to its status at finality
+// when the reverted event is what the deal currently reflects
+func (run *dealTrackingRun) settleDealEvents(ctx context.Context, finalityEpochs filabi.ChainEpoch) (finalized, reverted int, err error) {
+
+	if run.lts.Height() <= finalityEpochs {
+		return 0, 0, nil
+	}
+	fts, err := run.api.ChainGetTipSetByHeight(ctx, run.lts.Height()-finalityEpochs, run.lts.Key())
+	if err != nil {
+		return 0, 0, xerrors.Errorf("unable to retrieve tipset at finality: %w", err)
+	}
+
+	rows, err := cargoDb.Query(
+		ctx,
+		`
+		SELECT dev.entry_id, dev.deal_id, dev.status,
+				NOT EXISTS (
+					SELECT 42
+						FROM cargo.deal_events ldev
+					WHERE ldev.deal_id = dev.deal_id AND ldev.entry_id > dev.entry_id AND NOT ldev.reverted
+				) AS latest,
+				d.status, a.piece_cid, d.provider, d.start_epoch, d.end_epoch
+			FROM cargo.deal_events dev
+			JOIN cargo.deals d USING ( deal_id )
+			JOIN cargo.aggregates a USING ( aggregate_cid )
+		WHERE
+			NOT dev.final AND NOT dev.reverted
+				AND
+			dev.observed_epoch <= $1
+		ORDER BY dev.deal_id, dev.entry_id
+		`,
+		fts.Height(),
+	)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rows.Close()
+
+	var events []tentativeDealEvent
+	for rows.Next() {
+		var ev tentativeDealEvent
+		var pCidStr string
+		if err := rows.Scan(&ev.entryID, &ev.dealID, &ev.status, &ev.latest, &ev.dealStatus, &pCidStr, &ev.provider, &ev.startEpoch, &ev.endEpoch); err != nil {
+			return 0, 0, err
+		}
+		if ev.pieceCid, err = cid.Parse(pCidStr); err != nil {
+			return 0, 0, err
+		}
+		events = append(events, ev)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+	rows.Close()
+
+	if len(events) == 0 {
+		return 0, 0, nil
+	}
+
+	log.Infow("settling tentative deal events against", "state", fts.Key(), "epoch", fts.Height(), "events", len(events))
+
+	type finalStatus struct {
+		status string
+		meta   *string
+	}
+	statusAtFinality := make(map[int64]finalStatus)
+
+	finalIDs := make([]int64, 0, len(events))
+	revertedIDs := make([]int64, 0)
+	for _, ev := range events {
+
+		fs, seen := statusAtFinality[ev.dealID]
+		if !seen {
+			md, err := run.api.StateMarketStorageDeal(ctx, filabi.DealID(ev.dealID), fts.Key())
+			if err != nil {
+				// a missing deal is an answer too
+				if !isDealNotFound(err, ev.dealID) {
+					return 0, 0, xerrors.Errorf("retrieving deal %d at finality failed: %w", ev.dealID, err)
+				}
+			}
+
+			switch {
+			// the same deal ID may have been handed out to a different proposal on the surviving fork
+			case md != nil && md.Proposal.PieceCID == ev.pieceCid && md.Proposal.Provider.String() == ev.provider:
+				fs.status, fs.meta = run.dealStatusAt(run.aggCidLookup[ev.pieceCid], *md, fts.Height(), ev.dealStatus == "invalid")
+			case ev.endEpoch <= fts.Height():
+				fs.status = "expired"
+			case ev.startEpoch+filprovider.WPoStChallengeWindow < fts.Height():
+				fs.status = "terminated"
+			}
+			statusAtFinality[ev.dealID] = fs
+		}
+
+		if fs.status != "" && dealStatusRank(fs.status) >= dealStatusRank(ev.status) {
+			finalIDs = append(finalIDs, ev.entryID)
+			continue
+		}
+
+		revertedIDs = append(revertedIDs, ev.entryID)
+		log.Warnf("deal %d transition to '%s' no longer holds at finality epoch %d", ev.dealID, ev.status, fts.Height())
+
+		if !ev.latest || ev.dealStatus != ev.status {
+			continue
+		}
+
+		if fs.status == "" {
+			fs.status = "terminated"
+			m := "deal not part of market-actor state at finality"
+			fs.meta = &m
+		}
+		if _, err := cargoDb.Exec(
+			ctx,
+			`
+			UPDATE cargo.deals SET
+				status = $2,
+				status_meta = $3,
+				status_observed_epoch = $4,
+				status_observed_tipset_key = $5
+			WHERE deal_id = $1 AND status = $6
+			`,
+			ev.dealID,
+			fs.status,
+			fs.meta,
+			fts.Height(),
+			tipsetKeyStrings(fts),
+			ev.status,
+		); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	// the rollbacks above emit new events of their own: these are observed at
+	// finality, and will be settled by the next run
+	if _, err := cargoDb.Exec(
+		ctx,
+		`
+		UPDATE cargo.deal_events SET
+			final = ( entry_id = ANY ( $1::BIGINT[] ) ),
+			reverted = ( entry_id = ANY ( $2::BIGINT[] ) ),
+			entry_settled = NOW()
+		WHERE entry_id = ANY ( $1::BIGINT[] ) OR entry_id = ANY ( $2::BIGINT[] )
+		`,
+		finalIDs,
+		revertedIDs,
+	); err != nil {
+		return 0, 0, err
+	}
+
+	return len(finalIDs), len(revertedIDs), nil
+}
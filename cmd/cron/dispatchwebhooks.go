@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+)
+
+type webhookEndpoint struct {
+	url    string
+	secret string
+}
+
+type webhookEvent struct {
+	EventID   int64           `json:"event_id"`
+	Type      string          `json:"type"`
+	Project   int             `json:"project"`
+	Cid       string          `json:"cid"`
+	Data      json.RawMessage `json:"data"`
+	CreatedAt time.Time       `json:"created_at"`
+	attempts  int
+}
+
+var dispatchWebhooks = &cli.Command{
+	Usage: "Deliver pending webhook_outbox events to the webhook-endpoint of their project",
+	Name:  "dispatch-webhooks",
+	Description: "Only projects with a webhook-endpoint are subscribed to events: pending events of a project\n" +
+		"whose endpoint is removed are dropped, and a newly added one receives milestones reached from then on.",
+	Flags: []cli.Flag{
+		&cli.UintFlag{
+			Name:  "max-attempts",
+			Usage: "Move an event to the dead letters after failing this many times",
+			Value: 12,
+		},
+		&cli.UintFlag{
+			Name:  "batch-size",
+			Usage: "Deliver at most this many events per project per run",
+			Value: 5000,
+		},
+		&cli.UintFlag{
+			Name:  "events-per-request",
+			Usage: "Deliver up to this many events in a single POST, events being retried go out one by one",
+			Value: 100,
+		},
+		&cli.UintFlag{
+			Name:  "timeout-seconds",
+			Usage: "Consider a delivery failed if the endpoint does not respond within this long",
+			Value: 30,
+		},
+		&cli.UintFlag{
+			Name:  "retain-delivered-days",
+			Usage: "Remove delivered events from the outbox after this long",
+			Value: 30,
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+
+		ctx, closer := context.WithCancel(cctx.Context)
+		defer closer()
+
+		endpoints, err := webhookEndpointsFromConfig(cctx)
+		if err != nil {
+			return err
+		}
+
+		delivered := make(map[int]int)
+		failed := make(map[int]int)
+		deadLettered := make(map[int]int)
+		var requests int
+		var dropped, pruned int64
+		defer func() {
+			log.Infow("summary",
+				"projects", len(endpoints),
+				"requests", requests,
+				"delivered", delivered,
+				"failed", failed,
+				"deadLettered", deadLettered,
+				"droppedUnsubscribed", dropped,
+				"prunedDelivered", pruned,
+			)
+		}()
+
+		if dropped, err = syncWebhookSubscriptions(ctx, endpoints); err != nil {
+			return err
+		}
+
+		ct, err := cargoDb.Exec(
+			ctx,
+			`
+			DELETE FROM cargo.webhook_outbox
+			WHERE status = 'delivered' AND entry_delivered < NOW() - $1 * '1 day'::INTERVAL
+			`,
+			cctx.Uint("retain-delivered-days"),
+		)
+		if err != nil {
+			return err
+		}
+		pruned = ct.RowsAffected()
+
+		client := &http.Client{Timeout: time.Duration(cctx.Uint("timeout-seconds")) * time.Second}
+
+		for project, ep := range endpoints {
+
+			evs, err := pendingWebhookEvents(ctx, project, cctx.Uint("batch-size"))
+			if err != nil {
+				return err
+			}
+
+			for _, req := range webhookRequests(evs, int(cctx.Uint("events-per-request"))) {
+				ids := make([]int64, len(req))
+				for i := range req {
+					ids[i] = req[i].EventID
+				}
+
+				requests++
+				deliveryErr := ep.deliver(ctx, client, req)
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+
+				if deliveryErr == nil {
+					if _, err := cargoDb.Exec(
+						ctx,
+						`
+						UPDATE cargo.webhook_outbox SET
+							status = 'delivered',
+							attempts = attempts + 1,
+							entry_delivered = NOW()
+						WHERE event_id = ANY ( $1::BIGINT[] )
+						`,
+						ids,
+					); err != nil {
+						return err
+					}
+					delivered[project] += len(req)
+					continue
+				}
+
+				// back off exponentially, capped at a day
+				var dead int
+				if err := cargoDb.QueryRow(
+					ctx,
+					`
+					WITH upd AS (
+						UPDATE cargo.webhook_outbox SET
+							attempts = attempts + 1,
+							last_error = $2,
+							status = CASE WHEN attempts + 1 >= $3 THEN 'dead' ELSE 'pending' END,
+							next_attempt_at = NOW() + LEAST( '1 minute'::INTERVAL * POWER( 2, attempts ), '1 day'::INTERVAL )
+						WHERE event_id = ANY ( $1::BIGINT[] )
+						RETURNING status
+					)
+					SELECT COUNT(*) FILTER ( WHERE status = 'dead' ) FROM upd
+					`,
+					ids,
+					// response bodies are arbitrary bytes, TEXT can not hold NULs
+					strings.ReplaceAll(strings.ToValidUTF8(deliveryErr.Error(), "\uFFFD"), "\x00", "\uFFFD"),
+					cctx.Uint("max-attempts"),
+				).Scan(&dead); err != nil {
+					return err
+				}
+				deadLettered[project] += dead
+				failed[project] += len(req) - dead
+
+				// the endpoint is likely unwell: leave the rest for the next run, when
+				// only the failed events and later ones for the same dags are held back
+				log.Warnf("delivery of %d events to project %d failed, postponing them and the rest of this run: %s", len(req), project, deliveryErr)
+				break
+			}
+		}
+
+		return nil
+	},
+}
+
+// syncWebhookSubscriptions makes cargo.webhook_subscriptions match the
+// configured endpoints, dropping pending events of projects no longer listed
+func syncWebhookSubscriptions(ctx context.Context, endpoints map[int]webhookEndpoint) (int64, error) {
+	projects := make([]int, 0, len(endpoints))
+	for p := range endpoints {
+		projects = append(projects, p)
+	}
+
+	tx, err := cargoDb.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(context.Background()) //nolint:errcheck
+
+	if _, err := tx.Exec(
+		ctx,
+		`DELETE FROM cargo.webhook_subscriptions WHERE NOT project = ANY ( $1::INTEGER[] )`,
+		projects,
+	); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(
+		ctx,
+		`
+		INSERT INTO cargo.webhook_subscriptions ( project )
+			SELECT UNNEST( $1::INTEGER[] )
+		ON CONFLICT ( project ) DO NOTHING
+		`,
+		projects,
+	); err != nil {
+		return 0, err
+	}
+	ct, err := tx.Exec(
+		ctx,
+		`DELETE FROM cargo.webhook_outbox WHERE status = 'pending' AND NOT project = ANY ( $1::INTEGER[] )`,
+		projects,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return ct.RowsAffected(), tx.Commit(ctx)
+}
+
+// webhookRequests groups events into POSTs in delivery order. Events which
+// failed before go out on their own, so that one an endpoint keeps rejecting
+// does not take others down with it.
+func webhookRequests(evs []webhookEvent, perRequest int) [][]webhookEvent {
+	var reqs [][]webhookEvent
+	var cur []webhookEvent
+	for _, ev := range evs {
+		if ev.attempts > 0 {
+			if len(cur) > 0 {
+				reqs = append(reqs, cur)
+				cur = nil
+			}
+			reqs = append(reqs, []webhookEvent{ev})
+			continue
+		}
+		cur = append(cur, ev)
+		if len(cur) >= perRequest {
+			reqs = append(reqs, cur)
+			cur = nil
+		}
+	}
+	if len(cur) > 0 {
+		reqs = append(reqs, cur)
+	}
+	return reqs
+}
+
+func webhookEndpointsFromConfig(cctx *cli.Context) (map[int]webhookEndpoint, error) {
+	eps := make(map[int]webhookEndpoint)
+	for _, e := range cctx.StringSlice("webhook-endpoint") {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 {
+			return nil, xerrors.New("invalid webhook-endpoint entry, expected PROJECT=SECRET:URL")
+		}
+		project, err := strconv.Atoi(kv[0])
+		if err != nil {
+			return nil, xerrors.Errorf("invalid project '%s' in webhook-endpoint: %w", kv[0], err)
+		}
+		i := strings.IndexByte(kv[1], ':')
+		if i <= 0 || strings.HasPrefix(kv[1][i:], "://") {
+			return nil, xerrors.Errorf("webhook-endpoint of project %d lacks a signing secret", project)
+		}
+		eps[project] = webhookEndpoint{secret: kv[1][:i], url: kv[1][i+1:]}
+	}
+	return eps, nil
+}
+
+// pending events whose retry time has come. Delivery order is only kept per
+// dag: an event waits for every earlier pending event of the same dag, but not
+// for the rest of its project.
+func pendingWebhookEvents(ctx context.Context, project int, limit uint) ([]webhookEvent, error) {
+	rows, err := cargoDb.Query(
+		ctx,
+		`
+		SELECT o.event_id, o.milestone, o.cid_v1, o.payload, o.entry_created, o.attempts
+			FROM cargo.webhook_outbox o
+		WHERE
+			o.project = $1
+				AND
+			o.status = 'pending'
+				AND
+			o.next_attempt_at <= NOW()
+				AND
+			NOT EXISTS (
+				SELECT 42
+					FROM cargo.webhook_outbox e
+				WHERE e.project = o.project AND e.cid_v1 = o.cid_v1 AND e.status = 'pending' AND e.event_id < o.event_id
+			)
+		ORDER BY o.event_id
+		LIMIT $2
+		`,
+		project,
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	evs := make([]webhookEvent, 0, limit)
+	for rows.Next() {
+		ev := webhookEvent{Project: project}
+		if err := rows.Scan(&ev.EventID, &ev.Type, &ev.Cid, &ev.Data, &ev.CreatedAt, &ev.attempts); err != nil {
+			return nil, err
+		}
+		evs = append(evs, ev)
+	}
+	return evs, rows.Err()
+}
+
+// deliver POSTs a JSON array of events. X-Dagcargo-Signature is "sha256=" followed
+// by the hex HMAC-SHA256 of "{X-Dagcargo-Timestamp}.{body}" keyed by the shared
+// secret, which the receiver verifies. It should treat the event_id of every element as an idempotency key:
+// an event may arrive more than once.
+func (ep webhookEndpoint) deliver(ctx context.Context, client *http.Client, evs []webhookEvent) error {
+	body, err := json.Marshal(evs)
+	if err != nil {
+		return err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+
+	mac := hmac.New(sha256.New, []byte(ep.secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ep.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Dagcargo-Timestamp", ts)
+	req.Header.Set("X-Dagcargo-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return xerrors.Errorf("unexpected HTTP status '%s': %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
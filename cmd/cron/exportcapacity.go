@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/xerrors"
+)
+
+var errInsufficientExportSpace = xerrors.New("insufficient free space in export dir")
+
+// exportCapacityGuard tracks how many bytes the in-flight exports are still
+// expected to write, and only admits a new export when the free space of the
+// export dir (as reported by statfs) can absorb it on top of the configured headroom
+type exportCapacityGuard struct {
+	dir          string
+	headroom     uint64
+	waitForSpace bool
+
+	mu           sync.Mutex
+	inFlight     map[*exportReservation]struct{}
+	released     chan struct{} // closed and replaced on every release
+	reservedPeak uint64
+	lastFree     uint64
+}
+
+type exportReservation struct {
+	guard     *exportCapacityGuard
+	projected uint64
+	written   uint64 // atomic, advanced by the exporter via Write()
+}
+
+// Write allows the reservation to be placed in the exporter's io.MultiWriter,
+// so that bytes already on disk are not counted twice
+func (r *exportReservation) Write(b []byte) (int, error) {
+	atomic.AddUint64(&r.written, uint64(len(b)))
+	return len(b), nil
+}
+
+func (r *exportReservation) outstanding() uint64 {
+	if w := atomic.LoadUint64(&r.written); w < r.projected {
+		return r.projected - w
+	}
+	return 0
+}
+
+func newExportCapacityGuard(dir string, headroom uint64, waitForSpace bool) *exportCapacityGuard {
+	return &exportCapacityGuard{
+		dir:          dir,
+		headroom:     headroom,
+		waitForSpace: waitForSpace,
+		inFlight:     make(map[*exportReservation]struct{}),
+		released:     make(chan struct{}),
+	}
+}
+
+func (g *exportCapacityGuard) freeBytes() (uint64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(g.dir, &st); err != nil {
+		return 0, xerrors.Errorf("statfs of '%s' failed: %w", g.dir, err)
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
+
+// must be called with the mutex held
+func (g *exportCapacityGuard) outstandingLocked() (total uint64) {
+	for r := range g.inFlight {
+		total += r.outstanding()
+	}
+	return total
+}
+
+// reserve blocks until projected bytes fit, or returns errInsufficientExportSpace
+// when configured to skip, or when there are no in-flight exports that could
+// free up their reservation
+func (g *exportCapacityGuard) reserve(ctx context.Context, projected uint64) (*exportReservation, error) {
+	for {
+		g.mu.Lock()
+
+		free, err := g.freeBytes()
+		if err != nil {
+			g.mu.Unlock()
+			return nil, err
+		}
+		g.lastFree = free
+
+		outstanding := g.outstandingLocked()
+		if outstanding+projected+g.headroom <= free {
+			r := &exportReservation{guard: g, projected: projected}
+			g.inFlight[r] = struct{}{}
+			if outstanding+projected > g.reservedPeak {
+				g.reservedPeak = outstanding + projected
+			}
+			g.mu.Unlock()
+			return r, nil
+		}
+
+		if !g.waitForSpace || len(g.inFlight) == 0 {
+			g.mu.Unlock()
+			return nil, xerrors.Errorf(
+				"%w: %d bytes free, %d bytes reserved by %d in-flight exports, %d bytes projected, %d bytes headroom",
+				errInsufficientExportSpace, free, outstanding, len(g.inFlight), projected, g.headroom,
+			)
+		}
+
+		waitCh := g.released
+		g.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-waitCh:
+		}
+	}
+}
+
+func (r *exportReservation) release() {
+	g := r.guard
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if _, known := g.inFlight[r]; !known {
+		return
+	}
+	delete(g.inFlight, r)
+	close(g.released)
+	g.released = make(chan struct{})
+}
+
+func (g *exportCapacityGuard) stats() (lastFree, reservedPeak uint64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.lastFree, g.reservedPeak
+}
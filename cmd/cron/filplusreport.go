@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+)
+
+type filPlusDistribution struct {
+	Clients          []string                   `json:"clients"`
+	Since            *time.Time                 `json:"since"`
+	Until            time.Time                  `json:"until"`
+	GeneratedAt      time.Time                  `json:"generated_at"`
+	ProviderShareCap float64                    `json:"provider_share_cap_pct"`
+	Deals            int64                      `json:"deals"`
+	TotalBytes       int64                      `json:"total_bytes"`
+	VerifiedBytes    int64                      `json:"verified_bytes"`
+	UniqueBytes      int64                      `json:"unique_bytes"`
+	Providers        []filPlusProvider          `json:"providers"`
+	Replication      []filPlusReplicationBucket `json:"replication"`
+	Flagged          []string                   `json:"flagged_providers"`
+}
+
+type filPlusProvider struct {
+	Provider            string   `json:"provider"`
+	Deals               int64    `json:"deals"`
+	ActiveDeals         int64    `json:"active_deals"`
+	TotalBytes          int64    `json:"total_bytes"`
+	VerifiedBytes       int64    `json:"verified_bytes"`
+	UniqueBytes         int64    `json:"unique_bytes"`
+	DuplicateDeals      int64    `json:"duplicate_deals"`
+	SharePct            float64  `json:"share_pct"`
+	AdvertisesRetrieval bool     `json:"advertises_retrieval"`
+	RetrievalSuccessPct *float64 `json:"retrieval_success_pct"`
+	ExceedsCap          bool     `json:"exceeds_cap"`
+}
+
+// how many aggregates ended up with how many distinct providers
+type filPlusReplicationBucket struct {
+	Providers   int64   `json:"providers"`
+	Aggregates  int64   `json:"aggregates"`
+	UniqueBytes int64   `json:"unique_bytes"`
+	Deals       int64   `json:"deals"`
+	DealPct     float64 `json:"deal_pct"`
+}
+
+var filPlusReport = &cli.Command{
+	Usage: "Report DataCap distribution across providers, as requested by Fil+ allocators",
+	Name:  "fil-plus-report",
+	Flags: []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "client",
+			Usage: "Robust client address(es) to report on (default: every own-client)",
+		},
+		&cli.StringFlag{
+			Name:  "since",
+			Usage: "Only consider deals and direct claims starting on or after this YYYY-MM-DD date",
+		},
+		&cli.StringFlag{
+			Name:  "until",
+			Usage: "Only consider deals and direct claims starting before this YYYY-MM-DD date (default: now)",
+		},
+		&cli.Float64Flag{
+			Name:  "provider-share-cap-pct",
+			Usage: "Flag providers holding more than this percentage of the verified bytes",
+			Value: 25,
+		},
+		&cli.StringFlag{
+			Name:  "json",
+			Usage: "Write the JSON report to this file, - for stdout",
+		},
+		&cli.StringFlag{
+			Name:  "markdown",
+			Usage: "Write the Markdown report to this file, - for stdout",
+			Value: "-",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+
+		ctx, closer := context.WithCancel(cctx.Context)
+		defer closer()
+
+		rep := filPlusDistribution{
+			Clients:          cctx.StringSlice("client"),
+			Until:            time.Now(),
+			GeneratedAt:      time.Now(),
+			ProviderShareCap: cctx.Float64("provider-share-cap-pct"),
+		}
+		defer func() {
+			log.Infow("summary",
+				"clients", rep.Clients,
+				"deals", rep.Deals,
+				"providers", len(rep.Providers),
+				"flaggedProviders", rep.Flagged,
+			)
+		}()
+
+		if s := cctx.String("since"); s != "" {
+			t, err := time.Parse("2006-01-02", s)
+			if err != nil {
+				return xerrors.Errorf("invalid --since: %w", err)
+			}
+			rep.Since = &t
+		}
+		if s := cctx.String("until"); s != "" {
+			t, err := time.Parse("2006-01-02", s)
+			if err != nil {
+				return xerrors.Errorf("invalid --until: %w", err)
+			}
+			rep.Until = t
+		}
+
+		if len(rep.Clients) == 0 {
+			if err := cargoDb.QueryRow(
+				ctx,
+				`SELECT COALESCE( ARRAY_AGG( client ORDER BY client ), '{}' ) FROM cargo.clients WHERE own`,
+			).Scan(&rep.Clients); err != nil {
+				return err
+			}
+			if len(rep.Clients) == 0 {
+				return xerrors.New("no --client given and no own-client configured")
+			}
+		}
+
+		if err := rep.load(ctx); err != nil {
+			return err
+		}
+
+		if p := cctx.String("json"); p != "" {
+			if err := writeReport(p, func(w io.Writer) error {
+				enc := json.NewEncoder(w)
+				enc.SetIndent("", "  ")
+				return enc.Encode(rep)
+			}); err != nil {
+				return err
+			}
+		}
+		if p := cctx.String("markdown"); p != "" {
+			if err := writeReport(p, rep.writeMarkdown); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	},
+}
+
+func writeReport(path string, write func(io.Writer) error) error {
+	if path == "-" {
+		return write(os.Stdout)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close() //nolint:errcheck
+		return err
+	}
+	return f.Close()
+}
+
+func (rep *filPlusDistribution) load(ctx context.Context) error {
+
+	// invalid deals never spent DataCap, and are not ours to report on
+	// direct claims spend DataCap just like deals do, and are reported as such unless
+	// they are the claim behind one of the deals. An allocation expiring unclaimed
+	// hands its DataCap back.
+	const reportDeals = `
+		WITH
+			report_deals AS (
+				SELECT d.aggregate_cid, d.provider, d.status, d.verified, a.piece_size
+					FROM cargo.deals d
+					JOIN cargo.aggregates a USING ( aggregate_cid )
+				WHERE
+					d.client = ANY ( $1::TEXT[] )
+						AND
+					d.status != 'invalid'
+						AND
+					( $2::TIMESTAMP WITH TIME ZONE IS NULL OR d.start_time >= $2 )
+						AND
+					d.start_time < $3
+
+					UNION ALL
+
+				SELECT
+						vr.aggregate_cid,
+						vr.provider,
+						CASE vr.status WHEN 'allocated' THEN 'published' WHEN 'claimed' THEN 'active' ELSE vr.status END,
+						true,
+						a.piece_size
+					FROM cargo.verified_replicas vr
+					JOIN cargo.aggregates a USING ( aggregate_cid )
+				WHERE
+					vr.client = ANY ( $1::TEXT[] )
+						AND
+					NOT ( vr.status = 'expired' AND vr.term_start IS NULL )
+						AND
+					NOT EXISTS (
+						SELECT 42
+							FROM cargo.deals d
+						WHERE d.aggregate_cid = vr.aggregate_cid AND d.provider = vr.provider AND d.client = vr.client
+					)
+						AND
+					( $2::TIMESTAMP WITH TIME ZONE IS NULL OR COALESCE( cargo.epoch_to_timestamp( vr.term_start ), vr.entry_created ) >= $2 )
+						AND
+					COALESCE( cargo.epoch_to_timestamp( vr.term_start ), vr.entry_created ) < $3
+			)
+	`
+
+	rows, err := cargoDb.Query(
+		ctx,
+		reportDeals+`
+		SELECT
+				rd.provider,
+				COUNT(*) AS deals,
+				COUNT(*) FILTER ( WHERE rd.status IN ( 'active', 'expiring' ) ) AS active_deals,
+				SUM( rd.piece_size )::BIGINT AS total_bytes,
+				COALESCE( SUM( rd.piece_size ) FILTER ( WHERE rd.verified ), 0 )::BIGINT AS verified_bytes,
+				( SELECT SUM( piece_size ) FROM ( SELECT DISTINCT aggregate_cid, piece_size FROM report_deals u WHERE u.provider = rd.provider ) u )::BIGINT AS unique_bytes,
+				COUNT(*) - COUNT( DISTINCT rd.aggregate_cid ) AS duplicate_deals,
+				COALESCE( p.details->'chain_info'->'multiaddrs', '[]' ) AS multiaddrs,
+				( p.details->'retrieval'->>'success_ratio' )::FLOAT * 100 AS retrieval_success_pct
+			FROM report_deals rd
+			JOIN cargo.providers p USING ( provider )
+		GROUP BY rd.provider, p.details
+		ORDER BY total_bytes DESC, rd.provider
+		`,
+		rep.Clients,
+		rep.Since,
+		rep.Until,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p filPlusProvider
+		var maddrsJSON []byte
+		if err := rows.Scan(&p.Provider, &p.Deals, &p.ActiveDeals, &p.TotalBytes, &p.VerifiedBytes, &p.UniqueBytes, &p.DuplicateDeals, &maddrsJSON, &p.RetrievalSuccessPct); err != nil {
+			return err
+		}
+		// on-chain multiaddrs are mostly libp2p deal-making ones: only an http(s)
+		// one is something a retrieval client can use
+		var maddrs []string
+		if err := json.Unmarshal(maddrsJSON, &maddrs); err != nil {
+			return err
+		}
+		p.AdvertisesRetrieval = httpEndpointFromMultiaddrs(maddrs) != ""
+		rep.Deals += p.Deals
+		rep.TotalBytes += p.TotalBytes
+		rep.VerifiedBytes += p.VerifiedBytes
+		rep.Providers = append(rep.Providers, p)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	for i := range rep.Providers {
+		p := &rep.Providers[i]
+		if rep.VerifiedBytes > 0 {
+			p.SharePct = 100 * float64(p.VerifiedBytes) / float64(rep.VerifiedBytes)
+		}
+		if p.SharePct > rep.ProviderShareCap {
+			p.ExceedsCap = true
+			rep.Flagged = append(rep.Flagged, p.Provider)
+		}
+	}
+
+	rows, err = cargoDb.Query(
+		ctx,
+		reportDeals+`,
+			per_aggregate AS (
+				SELECT aggregate_cid, piece_size, COUNT( DISTINCT provider ) AS providers, COUNT(*) AS deals
+					FROM report_deals
+				GROUP BY aggregate_cid, piece_size
+			)
+		SELECT providers, COUNT(*), SUM( piece_size )::BIGINT, SUM( deals )::BIGINT
+			FROM per_aggregate
+		GROUP BY providers
+		ORDER BY providers
+		`,
+		rep.Clients,
+		rep.Since,
+		rep.Until,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var b filPlusReplicationBucket
+		if err := rows.Scan(&b.Providers, &b.Aggregates, &b.UniqueBytes, &b.Deals); err != nil {
+			return err
+		}
+		if rep.Deals > 0 {
+			b.DealPct = 100 * float64(b.Deals) / float64(rep.Deals)
+		}
+		rep.UniqueBytes += b.UniqueBytes
+		rep.Replication = append(rep.Replication, b)
+	}
+	return rows.Err()
+}
+
+func (rep *filPlusDistribution) writeMarkdown(out io.Writer) error {
+	w := bufio.NewWriter(out)
+
+	since := "the beginning"
+	if rep.Since != nil {
+		since = rep.Since.Format("2006-01-02")
+	}
+
+	fmt.Fprintf(w, "# DataCap Distribution Report\n\n")
+	fmt.Fprintf(w, "- Clients: %s\n", strings.Join(rep.Clients, ", "))
+	fmt.Fprintf(w, "- Deals starting between %s and %s\n", since, rep.Until.Format("2006-01-02"))
+	fmt.Fprintf(w, "- Generated at %s\n\n", rep.GeneratedAt.UTC().Format(time.RFC3339))
+
+	fmt.Fprintf(w, "## Summary\n\n")
+	fmt.Fprintf(w, "| Deals | Providers | Total Size | Verified Size | Unique Data |\n")
+	fmt.Fprintf(w, "|---:|---:|---:|---:|---:|\n")
+	fmt.Fprintf(w, "| %d | %d | %s | %s | %s |\n\n",
+		rep.Deals,
+		len(rep.Providers),
+		humanize.IBytes(uint64(rep.TotalBytes)),
+		humanize.IBytes(uint64(rep.VerifiedBytes)),
+		humanize.IBytes(uint64(rep.UniqueBytes)),
+	)
+
+	fmt.Fprintf(w, "## Storage Provider Distribution\n\n")
+	fmt.Fprintf(w, "| Provider | Total Deals | Active Deals | Total Size | Percentage | Unique Data | Duplicate Deals | Advertises Retrieval | Retrieval Success |\n")
+	fmt.Fprintf(w, "|---|---:|---:|---:|---:|---:|---:|:---:|---:|\n")
+	for _, p := range rep.Providers {
+		flag := ""
+		if p.ExceedsCap {
+			flag = " **(over cap)**"
+		}
+		retr := "no"
+		if p.AdvertisesRetrieval {
+			retr = "yes"
+		}
+		retrSuccess := "not probed"
+		if p.RetrievalSuccessPct != nil {
+			retrSuccess = fmt.Sprintf("%.2f%%", *p.RetrievalSuccessPct)
+		}
+		fmt.Fprintf(w, "| %s%s | %d | %d | %s | %.2f%% | %s | %d | %s | %s |\n",
+			p.Provider, flag,
+			p.Deals,
+			p.ActiveDeals,
+			humanize.IBytes(uint64(p.TotalBytes)),
+			p.SharePct,
+			humanize.IBytes(uint64(p.UniqueBytes)),
+			p.DuplicateDeals,
+			retr,
+			retrSuccess,
+		)
+	}
+	fmt.Fprintf(w, "\n")
+	if len(rep.Flagged) > 0 {
+		fmt.Fprintf(w, "**%d provider(s) hold more than %.2f%% of the verified bytes:** %s\n\n", len(rep.Flagged), rep.ProviderShareCap, strings.Join(rep.Flagged, ", "))
+	} else {
+		fmt.Fprintf(w, "No provider holds more than %.2f%% of the verified bytes\n\n", rep.ProviderShareCap)
+	}
+
+	fmt.Fprintf(w, "## Deal Data Replication\n\n")
+	fmt.Fprintf(w, "| Number of Providers | Aggregates | Unique Data Size | Total Deals Made | Deal Percentage |\n")
+	fmt.Fprintf(w, "|---:|---:|---:|---:|---:|\n")
+	for _, b := range rep.Replication {
+		fmt.Fprintf(w, "| %d | %d | %s | %d | %.2f%% |\n",
+			b.Providers,
+			b.Aggregates,
+			humanize.IBytes(uint64(b.UniqueBytes)),
+			b.Deals,
+			b.DealPct,
+		)
+	}
+
+	return w.Flush()
+}
@@ -139,6 +139,10 @@ type pgProject struct {
 	templatedSQLDetailsUpload         string
 	templatedSQLUploadAuthkeyFkColumn string
 	templatedSQLPsaUnion              string
+
+	// where push-deal-info writes, the only place we need a read-write connection
+	dealInfoPgConnString string
+	dealInfoTable        string
 }
 
 var pgProjects = []pgProject{
@@ -150,6 +154,8 @@ var pgProjects = []pgProject{
 		templatedSQLUploadAuthkeyFkColumn: w3sUploadAuthkeyFkColumn,
 		templatedSQLDetailsUpload:         w3sDetailsUpload,
 		templatedSQLPsaUnion:              w3sPsaUnion,
+		dealInfoPgConnString:              "service=web3-storage-stage-rw",
+		dealInfoTable:                     "public.cargo_deal_info",
 	},
 	{
 		id:                                1,
@@ -159,6 +165,8 @@ var pgProjects = []pgProject{
 		templatedSQLUploadAuthkeyFkColumn: w3sUploadAuthkeyFkColumn,
 		templatedSQLDetailsUpload:         w3sDetailsUpload,
 		templatedSQLPsaUnion:              w3sPsaUnion,
+		dealInfoPgConnString:              "service=web3-storage-rw",
+		dealInfoTable:                     "public.cargo_deal_info",
 	},
 	{
 		id:                                2,
@@ -167,6 +175,8 @@ var pgProjects = []pgProject{
 		templatedSQLDetailsUser:           nftsDetailsUser,
 		templatedSQLUploadAuthkeyFkColumn: nftsUploadAuthkeyFkColumn,
 		templatedSQLDetailsUpload:         nftsDetailsUpload,
+		dealInfoPgConnString:              "service=nft-storage-rw",
+		dealInfoTable:                     "public.cargo_deal_info",
 	},
 }
 
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/filecoin-project/go-jsonrpc"
+	lotusapi "github.com/filecoin-project/lotus/api"
+	filtypes "github.com/filecoin-project/lotus/chain/types"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+)
+
+// every lotus endpoint that served (part of) the current run, in order of use
+var lotusEndpointsServed []string
+
+// lotusEndpoint is one of lotus-api / lotus-apis: a URL or a multiaddr, either
+// optionally prefixed by TOKEN: . TOKEN:MULTIADDR is what lotus itself uses for
+// FULLNODE_API_INFO.
+type lotusEndpoint struct {
+	url   string
+	token string
+}
+
+type lotusNode struct {
+	lotusEndpoint
+	api      *lotusapi.FullNodeStruct
+	verifreg *verifRegAPI
+	events   *actorEventsAPI
+	closer   jsonrpc.ClientCloser
+	head     *filtypes.TipSet
+}
+
+func lotusEndpointsFromConfig(cctx *cli.Context) ([]lotusEndpoint, error) {
+	var eps []lotusEndpoint
+	for _, e := range append([]string{cctx.String("lotus-api")}, cctx.StringSlice("lotus-apis")...) {
+		if e == "" {
+			continue
+		}
+		ep, err := parseLotusEndpoint(e, cctx.String("lotus-api-token"))
+		if err != nil {
+			return nil, xerrors.Errorf("invalid lotus endpoint '%s': %w", e, err)
+		}
+		eps = append(eps, ep)
+	}
+	if len(eps) == 0 {
+		return nil, xerrors.New("no lotus-api endpoints configured")
+	}
+	return eps, nil
+}
+
+func parseLotusEndpoint(e string, defaultToken string) (lotusEndpoint, error) {
+	ep := lotusEndpoint{url: e, token: defaultToken}
+
+	// a bare multiaddr may well contain colons ( /ip6/::1/... )
+	if !strings.HasPrefix(e, "/") {
+		if i := strings.IndexByte(e, ':'); i > 0 && !strings.HasPrefix(e[i:], "://") {
+			ep.token, ep.url = e[:i], e[i+1:]
+		}
+	}
+
+	if strings.HasPrefix(ep.url, "/") {
+		// like lotus, plain http unless the multiaddr says otherwise
+		u, err := urlFromMultiaddr(ep.url, "http")
+		if err != nil {
+			return ep, err
+		}
+		if u == "" {
+			return ep, xerrors.New("multiaddr without a host")
+		}
+		ep.url = u
+	}
+
+	return ep, nil
+}
+
+func (ep lotusEndpoint) connect(ctx context.Context) (*lotusNode, error) {
+	var hdr http.Header
+	if ep.token != "" {
+		hdr = http.Header{"Authorization": []string{"Bearer " + ep.token}}
+	}
+
+	n := &lotusNode{
+		lotusEndpoint: ep,
+		api:           new(lotusapi.FullNodeStruct),
+		verifreg:      new(verifRegAPI),
+		events:        new(actorEventsAPI),
+	}
+	v0closer, err := jsonrpc.NewMergeClient(ctx, ep.url+"/rpc/v0", "Filecoin", []interface{}{&n.api.Internal, &n.api.CommonStruct.Internal, &n.verifreg.Internal}, hdr)
+	if err != nil {
+		return nil, err
+	}
+	// actor events are only served by the v1 API
+	v1closer, err := jsonrpc.NewMergeClient(ctx, ep.url+"/rpc/v1", "Filecoin", []interface{}{&n.events.Internal}, hdr)
+	if err != nil {
+		v0closer()
+		return nil, err
+	}
+	n.closer = func() {
+		v0closer()
+		v1closer()
+	}
+	return n, nil
+}
+
+// lotusFailover hands out the best node first, and moves on to the next one
+// whenever a call fails on the transport level ( jsonrpc.ErrClient ). Errors
+// returned by lotus itself are passed through unchanged.
+type lotusFailover struct {
+	mu    sync.Mutex
+	nodes []*lotusNode
+	cur   int
+}
+
+// lotusAPI checks every configured endpoint for being on the expected network
+// and in sync, and returns an API failing over between the healthy ones,
+// highest head first
+func lotusAPI(cctx *cli.Context) (*lotusapi.FullNodeStruct, func(), error) {
+	api, _, _, closer, err := lotusAPIWithExtensions(cctx)
+	return api, closer, err
+}
+
+// lotusAPIWithExtensions is lotusAPI, additionally returning the verified registry
+// and actor event methods our vendored lotus API predates, failing over in lockstep
+func lotusAPIWithExtensions(cctx *cli.Context) (*lotusapi.FullNodeStruct, *verifRegAPI, *actorEventsAPI, func(), error) {
+	eps, err := lotusEndpointsFromConfig(cctx)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	f := new(lotusFailover)
+	closer := func() {
+		for _, n := range f.nodes {
+			n.closer()
+		}
+	}
+
+	var unhealthy []string
+	for _, ep := range eps {
+		n, err := ep.connect(cctx.Context)
+		if err == nil {
+			if err = initFilNetwork(cctx, n.api); err == nil {
+				n.head, err = lotusSyncedHead(cctx.Context, n.api)
+			}
+			if err != nil {
+				n.closer()
+			}
+		}
+		if err != nil {
+			log.Warnf("lotus endpoint %s unusable: %s", ep.url, err)
+			unhealthy = append(unhealthy, ep.url+": "+err.Error())
+			continue
+		}
+		f.nodes = append(f.nodes, n)
+	}
+
+	if len(f.nodes) == 0 {
+		return nil, nil, nil, nil, xerrors.Errorf("none of the %d lotus endpoints are usable:\n\t%s", len(eps), strings.Join(unhealthy, "\n\t"))
+	}
+
+	sort.SliceStable(f.nodes, func(i, j int) bool {
+		return f.nodes[i].head.Height() > f.nodes[j].head.Height()
+	})
+
+	lotusEndpointsServed = append(lotusEndpointsServed, f.nodes[0].url)
+	log.Infow("using lotus endpoint", "endpoint", f.nodes[0].url, "height", f.nodes[0].head.Height(), "standby", len(f.nodes)-1)
+
+	api := new(lotusapi.FullNodeStruct)
+	f.wire(&api.Internal, func(n *lotusNode) interface{} { return &n.api.Internal })
+	f.wire(&api.CommonStruct.Internal, func(n *lotusNode) interface{} { return &n.api.CommonStruct.Internal })
+	vr := new(verifRegAPI)
+	f.wire(&vr.Internal, func(n *lotusNode) interface{} { return &n.verifreg.Internal })
+	ev := new(actorEventsAPI)
+	f.wire(&ev.Internal, func(n *lotusNode) interface{} { return &n.events.Internal })
+
+	return api, vr, ev, closer, nil
+}
+
+func (f *lotusFailover) current() (int, *lotusNode) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.cur, f.nodes[f.cur]
+}
+
+// failed advances past the node at idx, unless a concurrent call already did
+// so. Returns false when there is nothing left to fail over to.
+func (f *lotusFailover) failed(idx int, method string, err error) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if idx != f.cur {
+		return true
+	}
+	if f.cur+1 >= len(f.nodes) {
+		return false
+	}
+
+	f.cur++
+	lotusEndpointsServed = append(lotusEndpointsServed, f.nodes[f.cur].url)
+	log.Warnf("lotus endpoint %s failed during %s: %s; failing over to %s", f.nodes[idx].url, method, err, f.nodes[f.cur].url)
+	return true
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// wire fills every function field of the Internal struct at internal with a proxy to
+// the same field of the struct internals() selects on the current node
+func (f *lotusFailover) wire(internal interface{}, internals func(*lotusNode) interface{}) {
+	dst := reflect.ValueOf(internal).Elem()
+
+	for i := 0; i < dst.NumField(); i++ {
+		field := dst.Type().Field(i)
+		ft := field.Type
+		if ft.Kind() != reflect.Func {
+			continue
+		}
+		returnsErr := ft.NumOut() > 0 && ft.Out(ft.NumOut()-1) == errorType
+
+		fieldIdx := i
+		method := field.Name
+		dst.Field(i).Set(reflect.MakeFunc(ft, func(args []reflect.Value) []reflect.Value {
+			var ctx context.Context
+			if len(args) > 0 {
+				ctx, _ = args[0].Interface().(context.Context)
+			}
+
+			for {
+				idx, n := f.current()
+
+				fn := reflect.ValueOf(internals(n)).Elem().Field(fieldIdx)
+				var out []reflect.Value
+				if ft.IsVariadic() {
+					out = fn.CallSlice(args)
+				} else {
+					out = fn.Call(args)
+				}
+
+				if !returnsErr {
+					return out
+				}
+				errVal := out[len(out)-1]
+				if errVal.IsNil() {
+					return out
+				}
+				err := errVal.Interface().(error)
+
+				var clientErr *jsonrpc.ErrClient
+				if !errors.As(err, &clientErr) ||
+					(ctx != nil && ctx.Err() != nil) ||
+					!f.failed(idx, method, err) {
+					return out
+				}
+			}
+		}))
+	}
+}
@@ -10,7 +10,6 @@ import (
 	"regexp"
 	"time"
 
-	filactors "github.com/filecoin-project/specs-actors/actors/builtin"
 	fslock "github.com/ipfs/go-fs-lock"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/prometheus/client_golang/prometheus"
@@ -42,16 +41,53 @@ var globalFlags = []cli.Flag{
 	},
 	altsrc.NewStringFlag(&cli.StringFlag{
 		Name:  "lotus-api",
+		Usage: "Lotus endpoint as URL or multiaddr, optionally prefixed by TOKEN: as in FULLNODE_API_INFO",
 		Value: "http://localhost:1234",
 	}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+		Name:  "lotus-apis",
+		Usage: "Further lotus endpoints in the same form as lotus-api: the one with the highest synced head serves the run and the rest are used for failover",
+	}),
+	altsrc.NewStringFlag(&cli.StringFlag{
+		Name:        "lotus-api-token",
+		Usage:       "Lotus JSON-RPC token for endpoints not specifying their own, required only by commands making deals",
+		DefaultText: "  {{ private, read from config file }}  ",
+		Hidden:      true,
+	}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+		Name:  "own-client",
+		Usage: "Wallet addresses making deals on behalf of the service, only their deals count as replicas once track-deals records them (default: every client)",
+	}),
+	altsrc.NewInt64Flag(&cli.Int64Flag{
+		Name:        "filecoin-genesis-unix",
+		Usage:       "Genesis timestamp of the filecoin network",
+		DefaultText: "derived from lotus",
+	}),
+	altsrc.NewUintFlag(&cli.UintFlag{
+		Name:        "filecoin-block-delay-seconds",
+		Usage:       "Block delay of the filecoin network",
+		DefaultText: "derived from lotus",
+	}),
 	&cli.UintFlag{
-		Name:  "lotus-lookback-epochs",
-		Value: filDefaultLookback,
-		DefaultText: fmt.Sprintf("%d epochs / %ds",
-			filDefaultLookback,
-			filactors.EpochDurationSeconds*filDefaultLookback,
-		),
+		Name:        "lotus-lookback-epochs",
+		Value:       filDefaultLookback,
+		DefaultText: fmt.Sprintf("%d epochs", filDefaultLookback),
 	},
+	altsrc.NewUintFlag(&cli.UintFlag{
+		Name:  "target-replicas",
+		Usage: "Amount of non-terminated deals, in-flight proposals and reservations each aggregate should have",
+		Value: 5,
+	}),
+	altsrc.NewUintFlag(&cli.UintFlag{
+		Name:  "renewal-horizon-days",
+		Usage: "Queue an aggregate for renewal once fewer than target-replicas of its deals outlast this many days",
+		Value: 60,
+	}),
+	altsrc.NewUintFlag(&cli.UintFlag{
+		Name:  "datacap-low-replicas",
+		Usage: "Report the DataCap of an own client as low once it covers fewer aggregate replicas than this",
+		Value: 100,
+	}),
 	altsrc.NewStringFlag(&cli.StringFlag{
 		Name:  "cargo-pg-connstring",
 		Value: "postgres:///postgres?user=cargo&password=&host=/var/run/postgresql",
@@ -65,6 +101,12 @@ var globalFlags = []cli.Flag{
 		DefaultText: "  {{ private, read from config file }}  ",
 		Hidden:      true,
 	}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+		Name:        "webhook-endpoint",
+		Usage:       "Where dispatch-webhooks delivers the events of a project, as PROJECT=SECRET:URL",
+		DefaultText: "  {{ private, read from config file }}  ",
+		Hidden:      true,
+	}),
 	altsrc.NewStringFlag(&cli.StringFlag{
 		Name:        "prometheus_push_url",
 		DefaultText: "  {{ private, read from config file }}  ",
@@ -88,6 +130,18 @@ var globalFlags = []cli.Flag{
 var promURL, promUser, promPass string
 var nonAlpha = regexp.MustCompile(`[^a-zA-Z0-9]+`)
 
+// commands can append here, everything is pushed alongside the run_time/success gauges
+var runMetrics []prometheus.Collector
+
+func newRunGauge(name, help string, val float64) prometheus.Gauge {
+	g := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: nonAlpha.ReplaceAllString("dagcargo_"+currentCmd, `_`) + "_" + name,
+		Help: help,
+	})
+	g.Set(val)
+	return g
+}
+
 func main() {
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -127,6 +181,9 @@ func main() {
 				"success", logSuccess,
 				"took", took.String(),
 			}
+			if len(lotusEndpointsServed) > 0 {
+				logArgs = append(logArgs, "lotusEndpoints", lotusEndpointsServed)
+			}
 
 			tookGauge := prometheus.NewGauge(prometheus.GaugeOpts{
 				Name: fmt.Sprintf("%s_run_time", cmdFqName),
@@ -146,12 +203,15 @@ func main() {
 				successGauge.Set(0)
 			}
 
-			if promErr := prometheuspush.New(promURL, nonAlpha.ReplaceAllString(currentCmd, `_`)).
+			pusher := prometheuspush.New(promURL, nonAlpha.ReplaceAllString(currentCmd, `_`)).
 				Grouping("instance", promInstance).
 				BasicAuth(promUser, promPass).
 				Collector(tookGauge).
-				Collector(successGauge).
-				Push(); promErr != nil {
+				Collector(successGauge)
+			for _, c := range runMetrics {
+				pusher = pusher.Collector(c)
+			}
+			if promErr := pusher.Push(); promErr != nil {
 				log.Warnf("push of prometheus metrics to %s failed: %s", promURL, promErr)
 			}
 		}
@@ -194,6 +254,16 @@ func main() {
 			analyzeDags,
 			aggregateDags,
 			trackDeals,
+			makeDeals,
+			serveReservations,
+			refreshProviders,
+			probeRetrievals,
+			dispatchWebhooks,
+			pushDealInfo,
+			filPlusReport,
+			verifyAggregates,
+			rebuildAggregate,
+			reconcile,
 			pushMetrics,
 			pushHeavyMetrics,
 		},
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	filaddr "github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	filbig "github.com/filecoin-project/go-state-types/big"
+	lotusapi "github.com/filecoin-project/lotus/api"
+	"github.com/ipfs/go-cid"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+)
+
+type replicationCandidate struct {
+	aggregateCid cid.Cid
+	pieceCid     cid.Cid
+	pieceSize    filabi.PaddedPieceSize
+	replicas     int
+	holders      map[string]struct{}
+}
+
+var makeDeals = &cli.Command{
+	Usage: "Propose verified offline deals for aggregates below the target replica count",
+	Name:  "make-deals",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Required: true,
+			Name:     "client",
+			Usage:    "Wallet address of the lotus node to propose deals from",
+		},
+		&cli.UintFlag{
+			Name:  "max-proposals",
+			Usage: "Maximum amount of deals to propose during this run",
+			Value: 10,
+		},
+		&cli.UintFlag{
+			Name:  "max-in-flight-per-provider",
+			Usage: "Do not propose to a provider which has that many proposals or published deals not yet active",
+			Value: 10,
+		},
+		&cli.StringSliceFlag{
+			Name:  "provider",
+			Usage: "Only propose to these providers (default: any in cargo.providers)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "exclude-provider",
+			Usage: "Never propose to these providers",
+		},
+		&cli.UintFlag{
+			Name:  "duration-days",
+			Usage: "Requested deal duration",
+			Value: 520,
+		},
+		&cli.UintFlag{
+			Name:  "start-delay-hours",
+			Usage: "How far in the future the deal should start, giving the provider time to fetch and seal the piece",
+			Value: 72,
+		},
+		&cli.StringFlag{
+			Name:  "price-per-gib-epoch",
+			Usage: "Price per GiB per epoch in attoFIL",
+			Value: "0",
+		},
+		&cli.BoolFlag{
+			Name:  "unverified",
+			Usage: "Propose deals without using DataCap",
+		},
+		&cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Only log the proposals that would be made",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+
+		ctx, closer := context.WithCancel(cctx.Context)
+		defer closer()
+
+		client, err := filaddr.NewFromString(cctx.String("client"))
+		if err != nil {
+			return xerrors.Errorf("invalid client address: %w", err)
+		}
+		pricePerGiB, err := filbig.FromString(cctx.String("price-per-gib-epoch"))
+		if err != nil {
+			return xerrors.Errorf("invalid price-per-gib-epoch: %w", err)
+		}
+
+		pr := &proposalRun{
+			dryRun:       cctx.Bool("dry-run"),
+			target:       int(cctx.Uint("target-replicas")),
+			maxProposals: int(cctx.Uint("max-proposals")),
+			maxInFlight:  int(cctx.Uint("max-in-flight-per-provider")),
+			record:       recordDealProposal,
+			perProvider:  make(map[string]int),
+		}
+		defer func() {
+			log.Infow("summary",
+				"dryRun", pr.dryRun,
+				"proposed", pr.proposed,
+				"failed", pr.failed,
+				"unrecorded", pr.unrecorded,
+				"perProvider", pr.perProvider,
+			)
+		}()
+
+		api, apiClose, err := lotusAPI(cctx)
+		if err != nil {
+			return xerrors.Errorf("connecting to lotus failed: %w", err)
+		}
+		defer apiClose()
+		pr.api = api
+
+		lts, err := lotusLookbackTipset(cctx, api)
+		if err != nil {
+			return err
+		}
+
+		candidates, providerLoad, err := replicationCandidates(ctx, lts.Height(), pr.target)
+		if err != nil {
+			return err
+		}
+
+		providers, err := eligibleProviders(ctx, cctx.StringSlice("provider"), cctx.StringSlice("exclude-provider"))
+		if err != nil {
+			return err
+		}
+		if len(providers) == 0 {
+			return xerrors.New("no eligible providers")
+		}
+
+		log.Infof("%s aggregates below %d replicas, %d eligible providers", humanize.Comma(int64(len(candidates))), pr.target, len(providers))
+
+		startEpoch := lts.Height() + filNet.epochsIn(time.Hour*time.Duration(cctx.Uint("start-delay-hours")))
+		duration := uint64(filNet.epochsIn(24 * time.Hour * time.Duration(cctx.Uint("duration-days"))))
+		pr.dealParams = func(c *replicationCandidate, sp filaddr.Address) *lotusapi.StartDealParams {
+			return &lotusapi.StartDealParams{
+				Data: &storagemarket.DataRef{
+					TransferType: storagemarket.TTManual,
+					Root:         c.aggregateCid,
+					PieceCid:     &c.pieceCid,
+					PieceSize:    c.pieceSize.Unpadded(),
+				},
+				Wallet:            client,
+				Miner:             sp,
+				EpochPrice:        filbig.Div(filbig.Mul(pricePerGiB, filbig.NewInt(int64(c.pieceSize))), filbig.NewInt(1<<30)),
+				MinBlocksDuration: duration,
+				DealStartEpoch:    startEpoch,
+				FastRetrieval:     true,
+				VerifiedDeal:      !cctx.Bool("unverified"),
+			}
+		}
+
+		if err := pr.proposeReplicas(ctx, candidates, providers, providerLoad); err != nil {
+			return err
+		}
+		if pr.failed > 0 {
+			return xerrors.Errorf("%d deal proposals failed", pr.failed)
+		}
+		return nil
+	},
+}
+
+// proposalRun holds the limits and tallies of a single make-deals invocation
+type proposalRun struct {
+	api          *lotusapi.FullNodeStruct
+	dryRun       bool
+	target       int
+	maxProposals int
+	maxInFlight  int
+	dealParams   func(c *replicationCandidate, sp filaddr.Address) *lotusapi.StartDealParams
+	record       func(ctx context.Context, propCid cid.Cid, params *lotusapi.StartDealParams) error
+
+	proposed    int
+	failed      int
+	unrecorded  int
+	perProvider map[string]int
+}
+
+var errProposalNotRecorded = xerrors.New("deal proposal made but not recorded")
+
+// proposeReplicas walks the candidates in priority order, proposing each to the
+// least loaded eligible providers not yet holding it, until the candidate reaches
+// the target or the run runs out of proposals
+func (pr *proposalRun) proposeReplicas(ctx context.Context, candidates []*replicationCandidate, providers []filaddr.Address, providerLoad map[string]int) error {
+
+	for _, c := range candidates {
+		if pr.proposed+pr.failed >= pr.maxProposals {
+			break
+		}
+
+		// spread load: least busy first, shuffle to not always favor the same ones on ties
+		rand.Shuffle(len(providers), func(i, j int) { providers[i], providers[j] = providers[j], providers[i] })
+		sort.SliceStable(providers, func(i, j int) bool {
+			return providerLoad[providers[i].String()] < providerLoad[providers[j].String()]
+		})
+
+		for _, sp := range providers {
+			if c.replicas >= pr.target || pr.proposed+pr.failed >= pr.maxProposals {
+				break
+			}
+			if _, holds := c.holders[sp.String()]; holds {
+				continue
+			}
+			if providerLoad[sp.String()] >= pr.maxInFlight {
+				continue
+			}
+
+			err := pr.proposeDeal(ctx, pr.dealParams(c, sp))
+			if err != nil && !xerrors.Is(err, errProposalNotRecorded) {
+				pr.failed++
+				log.Errorf("proposing %s to %s failed: %s", c.aggregateCid, sp, err)
+				// do not retry a provider that just failed during this run
+				providerLoad[sp.String()] = pr.maxInFlight
+				continue
+			}
+
+			// the provider did receive the proposal, whether we managed to record it or not
+			pr.proposed++
+			pr.perProvider[sp.String()]++
+			providerLoad[sp.String()]++
+			c.replicas++
+			c.holders[sp.String()] = struct{}{}
+
+			// without the database there is no point in proposing further
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (pr *proposalRun) proposeDeal(ctx context.Context, params *lotusapi.StartDealParams) error {
+
+	if pr.dryRun {
+		log.Infow("would propose", "aggregate", params.Data.Root, "piece", params.Data.PieceCid, "provider", params.Miner, "startEpoch", params.DealStartEpoch)
+		return nil
+	}
+
+	propCid, err := pr.api.ClientStatelessDeal(ctx, params)
+	if err != nil {
+		return err
+	}
+	if propCid == nil {
+		return xerrors.New("no proposal cid returned")
+	}
+
+	log.Infow("proposed", "aggregate", params.Data.Root, "piece", params.Data.PieceCid, "provider", params.Miner, "proposal", propCid)
+
+	if err := pr.record(ctx, *propCid, params); err != nil {
+		pr.unrecorded++
+		// everything needed to insert the row by hand
+		log.Errorw("recording deal proposal failed",
+			"proposal", propCid,
+			"aggregate", params.Data.Root,
+			"client", params.Wallet,
+			"provider", params.Miner,
+			"startEpoch", params.DealStartEpoch,
+			"endEpoch", params.DealStartEpoch+filabi.ChainEpoch(params.MinBlocksDuration),
+			"verified", params.VerifiedDeal,
+			"pricePerEpoch", params.EpochPrice,
+			"error", err,
+		)
+		return xerrors.Errorf("%w: %s: %s", errProposalNotRecorded, propCid, err)
+	}
+	return nil
+}
+
+func recordDealProposal(ctx context.Context, propCid cid.Cid, params *lotusapi.StartDealParams) error {
+	_, err := cargoDb.Exec(
+		ctx,
+		`
+		INSERT INTO cargo.deal_proposals ( proposal_cid, aggregate_cid, client, provider, start_epoch, end_epoch, verified, price_per_epoch )
+			VALUES ( $1, $2, $3, $4, $5, $6, $7, $8 )
+		`,
+		propCid.String(),
+		params.Data.Root.String(),
+		params.Wallet.String(),
+		params.Miner.String(),
+		params.DealStartEpoch,
+		params.DealStartEpoch+filabi.ChainEpoch(params.MinBlocksDuration),
+		params.VerifiedDeal,
+		params.EpochPrice.String(),
+	)
+	return err
+}
+
+// replicationCandidates returns aggregates below target in cargo.aggregate_summary
+// priority order, and the amount of not-yet-active deals/proposals per provider.
+// A proposal counts as in-flight until its start epoch passes, or a deal from the
+// same provider for the same aggregate shows up. Active reservations count as in-flight too.
+func replicationCandidates(ctx context.Context, curEpoch filabi.ChainEpoch, target int) ([]*replicationCandidate, map[string]int, error) {
+
+	providerLoad := make(map[string]int)
+	holders := make(map[string]map[string]struct{})
+
+	rows, err := cargoDb.Query(
+		ctx,
+		`
+		SELECT d.aggregate_cid, d.provider, d.status = 'published'
+			FROM cargo.own_deals d
+		WHERE d.status NOT IN ( 'terminated', 'expired', 'slashed', 'invalid' )
+
+			UNION ALL
+
+		SELECT p.aggregate_cid, p.provider, true
+			FROM cargo.deal_proposals p
+		WHERE
+			p.start_epoch > $1
+				AND
+			NOT EXISTS (
+				SELECT 42
+					FROM cargo.own_deals d
+				WHERE d.aggregate_cid = p.aggregate_cid AND d.provider = p.provider
+			)
+
+			UNION ALL
+
+		SELECT vr.aggregate_cid, vr.provider, vr.status = 'allocated'
+			FROM cargo.own_direct_replicas vr
+
+			UNION ALL
+
+		SELECT r.aggregate_cid, r.provider, true
+			FROM cargo.reservations r
+		WHERE r.status = 'reserved' AND r.reserved_until > NOW()
+		`,
+		curEpoch,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var aggCid, provider string
+		var inFlight bool
+		if err := rows.Scan(&aggCid, &provider, &inFlight); err != nil {
+			return nil, nil, err
+		}
+		if inFlight {
+			providerLoad[provider]++
+		}
+		if holders[aggCid] == nil {
+			holders[aggCid] = make(map[string]struct{})
+		}
+		holders[aggCid][provider] = struct{}{}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	rows.Close()
+
+	rows, err = cargoDb.Query(
+		ctx,
+		`SELECT aggregate_cid, piece_cid, piece_size FROM cargo.aggregate_summary`,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	candidates := make([]*replicationCandidate, 0, 1<<10)
+	for rows.Next() {
+		var aggCidStr, pieceCidStr string
+		var pieceSize filabi.PaddedPieceSize
+		if err := rows.Scan(&aggCidStr, &pieceCidStr, &pieceSize); err != nil {
+			return nil, nil, err
+		}
+
+		c := &replicationCandidate{
+			pieceSize: pieceSize,
+			holders:   holders[aggCidStr],
+		}
+		if c.holders == nil {
+			c.holders = make(map[string]struct{})
+		}
+		c.replicas = len(c.holders)
+		if c.replicas >= target {
+			continue
+		}
+		if c.aggregateCid, err = cid.Parse(aggCidStr); err != nil {
+			return nil, nil, err
+		}
+		if c.pieceCid, err = cid.Parse(pieceCidStr); err != nil {
+			return nil, nil, err
+		}
+		candidates = append(candidates, c)
+	}
+
+	return candidates, providerLoad, rows.Err()
+}
+
+func eligibleProviders(ctx context.Context, allow, exclude []string) ([]filaddr.Address, error) {
+
+	excluded := make(map[string]struct{}, len(exclude))
+	for _, sp := range exclude {
+		excluded[sp] = struct{}{}
+	}
+
+	var allowed map[string]struct{}
+	if len(allow) > 0 {
+		allowed = make(map[string]struct{}, len(allow))
+		for _, sp := range allow {
+			allowed[sp] = struct{}{}
+		}
+	}
+
+	// explicitly requested providers may not have any deals with us yet
+	for sp := range allowed {
+		if _, err := cargoDb.Exec(
+			ctx,
+			`
+			INSERT INTO cargo.providers ( provider ) VALUES ( $1 )
+				ON CONFLICT ( provider ) DO NOTHING
+			`,
+			sp,
+		); err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := cargoDb.Query(ctx, `SELECT provider FROM cargo.providers`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	providers := make([]filaddr.Address, 0, 128)
+	for rows.Next() {
+		var sp string
+		if err := rows.Scan(&sp); err != nil {
+			return nil, err
+		}
+		if _, skip := excluded[sp]; skip {
+			continue
+		}
+		if allowed != nil {
+			if _, ok := allowed[sp]; !ok {
+				continue
+			}
+		}
+		a, err := filaddr.NewFromString(sp)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, a)
+	}
+
+	return providers, rows.Err()
+}
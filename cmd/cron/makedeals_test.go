@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+
+	filaddr "github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	"github.com/filecoin-project/go-jsonrpc"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	filbig "github.com/filecoin-project/go-state-types/big"
+	lotusapi "github.com/filecoin-project/lotus/api"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"golang.org/x/xerrors"
+)
+
+// mockLotus serves the Filecoin.* methods make-deals calls, over the same
+// JSON-RPC transport a real node uses
+type mockLotus struct {
+	mu        sync.Mutex
+	rejectBy  map[string]struct{}
+	proposals []lotusapi.StartDealParams
+}
+
+func (m *mockLotus) ClientStatelessDeal(ctx context.Context, params *lotusapi.StartDealParams) (*cid.Cid, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, reject := m.rejectBy[params.Miner.String()]; reject {
+		return nil, xerrors.Errorf("provider %s is not accepting deals", params.Miner)
+	}
+	m.proposals = append(m.proposals, *params)
+
+	propCid, err := cid.V1Builder{Codec: cid.DagCBOR, MhType: multihash.SHA2_256}.Sum([]byte(params.Miner.String() + params.Data.Root.String()))
+	if err != nil {
+		return nil, err
+	}
+	return &propCid, nil
+}
+
+func startMockLotus(t *testing.T, m *mockLotus) *lotusapi.FullNodeStruct {
+	t.Helper()
+
+	rpc := jsonrpc.NewServer()
+	rpc.Register("Filecoin", m)
+	srv := httptest.NewServer(rpc)
+	t.Cleanup(srv.Close)
+
+	n, err := lotusEndpoint{url: srv.URL}.connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(n.closer)
+	return n.api
+}
+
+type recordedProposal struct {
+	proposal  cid.Cid
+	aggregate string
+	provider  string
+}
+
+func testProposalRun(api *lotusapi.FullNodeStruct, rec *[]recordedProposal) *proposalRun {
+	client, _ := filaddr.NewIDAddress(1234)
+	return &proposalRun{
+		api:          api,
+		target:       3,
+		maxProposals: 100,
+		maxInFlight:  2,
+		perProvider:  make(map[string]int),
+		dealParams: func(c *replicationCandidate, sp filaddr.Address) *lotusapi.StartDealParams {
+			return &lotusapi.StartDealParams{
+				Data: &storagemarket.DataRef{
+					TransferType: storagemarket.TTManual,
+					Root:         c.aggregateCid,
+					PieceCid:     &c.pieceCid,
+					PieceSize:    c.pieceSize.Unpadded(),
+				},
+				Wallet:            client,
+				Miner:             sp,
+				EpochPrice:        filbig.Zero(),
+				MinBlocksDuration: 1000,
+				DealStartEpoch:    100,
+				VerifiedDeal:      true,
+			}
+		},
+		record: func(ctx context.Context, propCid cid.Cid, params *lotusapi.StartDealParams) error {
+			*rec = append(*rec, recordedProposal{propCid, params.Data.Root.String(), params.Miner.String()})
+			return nil
+		},
+	}
+}
+
+func testCandidate(t *testing.T, name string, holders ...string) *replicationCandidate {
+	t.Helper()
+	b := cid.V1Builder{Codec: cid.Raw, MhType: multihash.SHA2_256}
+	aggCid, err := b.Sum([]byte("aggregate " + name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pieceCid, err := b.Sum([]byte("piece " + name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &replicationCandidate{
+		aggregateCid: aggCid,
+		pieceCid:     pieceCid,
+		pieceSize:    filabi.PaddedPieceSize(32 << 30),
+		holders:      make(map[string]struct{}),
+	}
+	for _, h := range holders {
+		c.holders[h] = struct{}{}
+	}
+	c.replicas = len(c.holders)
+	return c
+}
+
+func testProviders(t *testing.T, ids ...uint64) []filaddr.Address {
+	t.Helper()
+	sps := make([]filaddr.Address, 0, len(ids))
+	for _, id := range ids {
+		sp, err := filaddr.NewIDAddress(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sps = append(sps, sp)
+	}
+	return sps
+}
+
+func holdersOf(rec []recordedProposal, c *replicationCandidate) []string {
+	var sps []string
+	for _, r := range rec {
+		if r.aggregate == c.aggregateCid.String() {
+			sps = append(sps, r.provider)
+		}
+	}
+	sort.Strings(sps)
+	return sps
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestProposeReplicas(t *testing.T) {
+	m := &mockLotus{rejectBy: map[string]struct{}{"f01002": {}}}
+	var rec []recordedProposal
+	pr := testProposalRun(startMockLotus(t, m), &rec)
+
+	a := testCandidate(t, "a", "f01000")
+	b := testCandidate(t, "b")
+	c := testCandidate(t, "c")
+
+	// f01003 is already at max-in-flight, f01002 rejects everything
+	load := map[string]int{"f01003": 2}
+
+	if err := pr.proposeReplicas(context.Background(), []*replicationCandidate{a, b, c}, testProviders(t, 1000, 1001, 1002, 1003), load); err != nil {
+		t.Fatal(err)
+	}
+
+	if pr.failed != 1 {
+		t.Errorf("expected the rejecting provider to be tried exactly once, got %d failures", pr.failed)
+	}
+	if pr.proposed != 4 || len(rec) != 4 || len(m.proposals) != 4 {
+		t.Fatalf("expected 4 proposals, got %d proposed, %d recorded, %d received by lotus", pr.proposed, len(rec), len(m.proposals))
+	}
+
+	// a already sits with f01000, b and c then exhaust f01001 and f01000 in turn
+	for _, tc := range []struct {
+		c        *replicationCandidate
+		expected []string
+	}{
+		{a, []string{"f01001"}},
+		{b, []string{"f01000", "f01001"}},
+		{c, []string{"f01000"}},
+	} {
+		if got := holdersOf(rec, tc.c); !equalStrings(got, tc.expected) {
+			t.Errorf("aggregate %s: expected proposals to %v, got %v", tc.c.aggregateCid, tc.expected, got)
+		}
+	}
+
+	if load["f01000"] != 2 || load["f01001"] != 2 || load["f01002"] != 2 {
+		t.Errorf("unexpected provider load after run: %v", load)
+	}
+
+	// what lotus received survived the JSON-RPC roundtrip intact
+	for _, p := range m.proposals {
+		if p.Data.TransferType != storagemarket.TTManual || p.Data.PieceCid == nil || !p.VerifiedDeal {
+			t.Errorf("unexpected proposal params %+v", p)
+		}
+	}
+	for _, r := range rec {
+		if !r.proposal.Defined() {
+			t.Errorf("recorded proposal to %s without a proposal cid", r.provider)
+		}
+	}
+}
+
+func TestProposeReplicasMaxProposals(t *testing.T) {
+	var rec []recordedProposal
+	pr := testProposalRun(startMockLotus(t, new(mockLotus)), &rec)
+	pr.maxProposals = 3
+
+	cands := []*replicationCandidate{testCandidate(t, "a"), testCandidate(t, "b")}
+	if err := pr.proposeReplicas(context.Background(), cands, testProviders(t, 1000, 1001, 1002, 1003), make(map[string]int)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the highest priority candidate is filled up first
+	if pr.proposed != 3 || len(holdersOf(rec, cands[0])) != 3 || len(holdersOf(rec, cands[1])) != 0 {
+		t.Errorf("expected the first candidate to take all 3 proposals, got %v and %v", holdersOf(rec, cands[0]), holdersOf(rec, cands[1]))
+	}
+}
+
+func TestProposeReplicasUnrecorded(t *testing.T) {
+	m := new(mockLotus)
+	var rec []recordedProposal
+	pr := testProposalRun(startMockLotus(t, m), &rec)
+	pr.record = func(ctx context.Context, propCid cid.Cid, params *lotusapi.StartDealParams) error {
+		return xerrors.New("connection reset")
+	}
+
+	load := make(map[string]int)
+	err := pr.proposeReplicas(context.Background(), []*replicationCandidate{testCandidate(t, "a")}, testProviders(t, 1000, 1001), load)
+	if !xerrors.Is(err, errProposalNotRecorded) {
+		t.Fatalf("expected the run to stop with an unrecorded proposal, got %v", err)
+	}
+
+	// the provider did get the proposal: it is not a failure, nor excluded
+	if len(m.proposals) != 1 || pr.proposed != 1 || pr.unrecorded != 1 || pr.failed != 0 {
+		t.Errorf("expected 1 proposed and unrecorded, got %d received, %d proposed, %d unrecorded, %d failed", len(m.proposals), pr.proposed, pr.unrecorded, pr.failed)
+	}
+	for sp, l := range load {
+		if l != 1 {
+			t.Errorf("expected provider %s to carry 1 in-flight proposal, got %d", sp, l)
+		}
+	}
+}
+
+func TestProposeReplicasDryRun(t *testing.T) {
+	m := new(mockLotus)
+	var rec []recordedProposal
+	pr := testProposalRun(startMockLotus(t, m), &rec)
+	pr.dryRun = true
+
+	if err := pr.proposeReplicas(context.Background(), []*replicationCandidate{testCandidate(t, "a")}, testProviders(t, 1000, 1001), make(map[string]int)); err != nil {
+		t.Fatal(err)
+	}
+	if pr.proposed != 2 || len(m.proposals) != 0 || len(rec) != 0 {
+		t.Errorf("dry run should plan 2 proposals without sending or recording them, got %d planned, %d sent, %d recorded", pr.proposed, len(m.proposals), len(rec))
+	}
+}
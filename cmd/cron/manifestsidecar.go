@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/filecoin-project/go-dagaggregator-unixfs"
+)
+
+const manifestSidecarSuffix = ".manifest.ndjson"
+
+type manifestSidecarSummary struct {
+	aggregateMetadata
+	AggregateCid string `json:"aggregate_cid"`
+	PieceCid     string `json:"piece_cid"`
+	PieceSize    uint64 `json:"piece_size"`
+	CarSize      uint64 `json:"car_size"`
+}
+
+type manifestSidecarEntry struct {
+	*dagaggregator.ManifestDagEntry
+	DatamodelSelector string
+}
+
+// writeManifestSidecar places a self-describing ndjson manifest next to the
+// car file of an aggregate, so it can be interpreted without access to our db.
+// The file is assembled under a dot-prefixed temporary name, synced and
+// renamed into place once complete.
+func writeManifestSidecar(outDir string, res *aggregateResult, isTimeboxed bool) (_ string, err error) {
+	fn := fmt.Sprintf("%s/%s", outDir, aggregateManifestName(fmt.Sprintf("%x", res.carMd5), res.carCommp.String()))
+
+	tmpFh, err := os.CreateTemp(outDir, "."+aggregateManifestName(fmt.Sprintf("%x", res.carMd5), res.carCommp.String())+".")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			tmpFh.Close()           //nolint:errcheck
+			os.Remove(tmpFh.Name()) //nolint:errcheck
+		}
+	}()
+
+	buf := bufio.NewWriter(tmpFh)
+	enc := json.NewEncoder(buf)
+
+	if err = enc.Encode(dagaggregator.CurrentManifestPreamble); err != nil {
+		return "", err
+	}
+	if err = enc.Encode(manifestSidecarSummary{
+		aggregateMetadata: newAggregateMetadata(res, isTimeboxed),
+		AggregateCid:      res.carRoot.String(),
+		PieceCid:          res.carCommp.String(),
+		PieceSize:         uint64(res.carPieceSize),
+		CarSize:           res.carSize,
+	}); err != nil {
+		return "", err
+	}
+	for _, e := range res.manifestEntries {
+		if err = enc.Encode(manifestSidecarEntry{
+			ManifestDagEntry:  e,
+			DatamodelSelector: manifestEntrySelector(e),
+		}); err != nil {
+			return "", err
+		}
+	}
+
+	if err = buf.Flush(); err != nil {
+		return "", err
+	}
+	if err = tmpFh.Sync(); err != nil {
+		return "", err
+	}
+	if err = tmpFh.Chmod(unixReadable); err != nil {
+		return "", err
+	}
+	if err = tmpFh.Close(); err != nil {
+		return "", err
+	}
+	if err = os.Rename(tmpFh.Name(), fn); err != nil {
+		return "", err
+	}
+
+	return fn, nil
+}
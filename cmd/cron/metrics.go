@@ -23,6 +23,7 @@ type cargoMetric struct {
 	name  string
 	help  string
 	query string
+	args  func(cctx *cli.Context) []interface{}
 	heavy bool
 }
 
@@ -604,12 +605,12 @@ var metricsList = []cargoMetric{
 	{
 		kind: cargoMetricGauge,
 		name: "dagcargo_filecoin_deals",
-		help: "Count of filecoin deals for aggregates packaged by the service",
+		help: "Count of filecoin deals made by our own clients for aggregates packaged by the service",
 		query: `
 			WITH
 				dealstates AS (
 					SELECT status, COUNT(*) val
-						FROM cargo.deals
+						FROM cargo.own_deals
 					GROUP BY status
 				)
 			SELECT d.status, COALESCE( dealstates.val, 0 ) AS val
@@ -617,6 +618,134 @@ var metricsList = []cargoMetric{
 				LEFT JOIN dealstates USING ( status )
 		`,
 	},
+	{
+		kind: cargoMetricGauge,
+		name: "dagcargo_filecoin_foreign_deals",
+		help: "Count of filecoin deals made by other clients for aggregates packaged by the service",
+		query: `
+			WITH
+				dealstates AS (
+					SELECT status, COUNT(*) val
+						FROM cargo.foreign_deals
+					GROUP BY status
+				)
+			SELECT d.status, COALESCE( dealstates.val, 0 ) AS val
+				FROM ( SELECT DISTINCT( status ) FROM cargo.deals ) d
+				LEFT JOIN dealstates USING ( status )
+		`,
+	},
+	{
+		kind: cargoMetricGauge,
+		name: "dagcargo_filecoin_verified_replicas",
+		help: "Count of verified registry allocations and claims for aggregates packaged by the service",
+		query: `
+			WITH
+				replicastates AS (
+					SELECT status, COUNT(*) val
+						FROM cargo.verified_replicas
+					GROUP BY status
+				)
+			SELECT s.status, COALESCE( replicastates.val, 0 ) AS val
+				FROM ( SELECT UNNEST( ARRAY[ 'allocated', 'claimed', 'expired', 'terminated' ] ) AS status ) s
+				LEFT JOIN replicastates USING ( status )
+		`,
+	},
+	{
+		kind: cargoMetricGauge,
+		name: "dagcargo_webhook_outbox_pending",
+		help: "Count of webhook events awaiting delivery per project",
+		query: `
+			WITH
+				q AS (
+					SELECT project, COUNT(*) AS val
+						FROM cargo.webhook_outbox
+					WHERE status = 'pending'
+					GROUP BY project
+				)
+			SELECT p.project::TEXT, COALESCE( q.val, 0 ) AS val
+				FROM cargo.webhook_subscriptions p
+				LEFT JOIN q USING ( project )
+		`,
+	},
+	{
+		kind: cargoMetricGauge,
+		name: "dagcargo_webhook_outbox_dead",
+		help: "Count of webhook events that exhausted their delivery attempts per project",
+		query: `
+			WITH
+				q AS (
+					SELECT project, COUNT(*) AS val
+						FROM cargo.webhook_outbox
+					WHERE status = 'dead'
+					GROUP BY project
+				)
+			SELECT p.project::TEXT, COALESCE( q.val, 0 ) AS val
+				FROM cargo.webhook_subscriptions p
+				LEFT JOIN q USING ( project )
+		`,
+	},
+	{
+		kind: cargoMetricGauge,
+		name: "dagcargo_filecoin_active_deal_sectors",
+		help: "Count of active filecoin deals by state of their containing sector, as of the last track-deals --check-sectors",
+		query: `
+			SELECT COALESCE( sector_state, 'unknown' ) AS sector_state, COUNT(*) AS val
+				FROM cargo.own_deals
+			WHERE status IN ( 'active', 'expiring' )
+			GROUP BY sector_state
+		`,
+	},
+	{
+		kind: cargoMetricGauge,
+		name: "dagcargo_aggregates_pending_renewal",
+		help: "Count of aggregates whose lasting replicas drop below --target-replicas within the next --renewal-horizon-days",
+		query: `
+			SELECT COUNT(*) FROM cargo.renewal_queue( $1::INTEGER, MAKE_INTERVAL( days => $2::INTEGER ) )
+		`,
+		args: func(cctx *cli.Context) []interface{} {
+			return []interface{}{int(cctx.Uint("target-replicas")), int(cctx.Uint("renewal-horizon-days"))}
+		},
+	},
+	{
+		kind: cargoMetricGauge,
+		name: "dagcargo_provider_minutes_publish_to_active_median",
+		help: "Median minutes between a deal being observed as published and its sector activating, as of the last track-deals",
+		query: `
+			SELECT provider, ( details->'scorecard'->>'median_seconds_publish_to_active' )::BIGINT / 60 AS val
+				FROM cargo.providers
+			WHERE details ? 'scorecard'
+		`,
+	},
+	{
+		kind: cargoMetricGauge,
+		name: "dagcargo_provider_retrieval_success_permille",
+		help: "Per-mille of retrieval probes against active deals that succeeded over the past week, as of the last probe-retrievals",
+		query: `
+			SELECT provider, ROUND( ( details->'retrieval'->>'success_ratio' )::NUMERIC * 1000 )::BIGINT AS val
+				FROM cargo.providers
+			WHERE details ? 'retrieval'
+		`,
+	},
+	{
+		kind: cargoMetricGauge,
+		name: "dagcargo_provider_retrieval_ttfb_milliseconds_median",
+		help: "Median milliseconds to first byte of successful retrieval probes over the past week, as of the last probe-retrievals",
+		query: `
+			SELECT provider, ( details->'retrieval'->>'median_ttfb_ms' )::BIGINT AS val
+				FROM cargo.providers
+			WHERE details->'retrieval'->>'median_ttfb_ms' IS NOT NULL
+		`,
+	},
+	{
+		kind: cargoMetricGauge,
+		name: "dagcargo_provider_deals_missed_start_permille",
+		help: "Per-mille of deals with a known outcome that were retired without ever activating, as of the last track-deals",
+		query: `
+			SELECT provider, ROUND( ( details->'scorecard'->>'missed_start_ratio' )::NUMERIC * 1000 )::BIGINT AS val
+				FROM cargo.providers
+			WHERE details ? 'scorecard'
+		`,
+	},
 	{
 		heavy: true,
 		kind:  cargoMetricGauge,
@@ -634,13 +763,13 @@ var metricsList = []cargoMetric{
 							AND
 						EXISTS (
 							SELECT 42
-								FROM cargo.aggregate_entries ae, cargo.deals de
+								FROM cargo.aggregate_entries ae, cargo.own_deals de
 							WHERE
 								ae.cid_v1 = ds.cid_v1
 									AND
 								ae.aggregate_cid = de.aggregate_cid
 									AND
-								de.status = 'active'
+								de.status IN ( 'active', 'expiring' )
 						)
 					GROUP BY s.project
 				)
@@ -666,13 +795,13 @@ var metricsList = []cargoMetric{
 							AND
 						EXISTS (
 							SELECT 42
-								FROM cargo.aggregate_entries ae, cargo.deals de
+								FROM cargo.aggregate_entries ae, cargo.own_deals de
 							WHERE
 								ae.cid_v1 = ds.cid_v1
 									AND
 								ae.aggregate_cid = de.aggregate_cid
 									AND
-								de.status = 'active'
+								de.status IN ( 'active', 'expiring' )
 						)
 					GROUP BY s.project
 				)
@@ -704,13 +833,13 @@ var metricsList = []cargoMetric{
 							AND
 						NOT EXISTS (
 							SELECT 42
-								FROM cargo.aggregate_entries ae, cargo.deals de
+								FROM cargo.aggregate_entries ae, cargo.own_deals de
 							WHERE
 								ae.cid_v1 = ds.cid_v1
 									AND
 								ae.aggregate_cid = de.aggregate_cid
 									AND
-								de.status = 'active'
+								de.status IN ( 'active', 'expiring' )
 						)
 					GROUP BY s.project
 				)
@@ -742,13 +871,13 @@ var metricsList = []cargoMetric{
 							AND
 						NOT EXISTS (
 							SELECT 42
-								FROM cargo.aggregate_entries ae, cargo.deals de
+								FROM cargo.aggregate_entries ae, cargo.own_deals de
 							WHERE
 								ae.cid_v1 = ds.cid_v1
 									AND
 								ae.aggregate_cid = de.aggregate_cid
 									AND
-								de.status = 'active'
+								de.status IN ( 'active', 'expiring' )
 						)
 					GROUP BY s.project
 				)
@@ -780,13 +909,13 @@ var metricsList = []cargoMetric{
 							AND
 						NOT EXISTS (
 							SELECT 42
-								FROM cargo.aggregate_entries ae, cargo.deals de
+								FROM cargo.aggregate_entries ae, cargo.own_deals de
 							WHERE
 								ae.cid_v1 = ds.cid_v1
 									AND
 								ae.aggregate_cid = de.aggregate_cid
 									AND
-								de.status = 'active'
+								de.status IN ( 'active', 'expiring' )
 						)
 							AND
 						-- ensure we are not a part of something else aggregated
@@ -891,6 +1020,80 @@ var metricsList = []cargoMetric{
 	},
 }
 
+// own-client DataCap, as of the last track-deals
+func init() {
+	metricsList = append(metricsList,
+		cargoMetric{
+			kind: cargoMetricGauge,
+			name: "dagcargo_filecoin_client_datacap_bytes",
+			help: "Remaining DataCap of our own clients",
+			query: `
+				SELECT client, LEAST( filp_available, 9223372036854775807 )::BIGINT AS val
+					FROM cargo.clients
+				WHERE own
+			`,
+		},
+		cargoMetric{
+			kind: cargoMetricGauge,
+			name: "dagcargo_filecoin_client_datacap_burn_bytes_per_day",
+			help: "DataCap used per day by our own clients over the past week",
+			query: `
+				SELECT client, burn_bytes_per_day AS val
+					FROM cargo.client_datacap_projection
+			`,
+		},
+		cargoMetric{
+			kind: cargoMetricGauge,
+			name: "dagcargo_filecoin_client_datacap_days_remaining",
+			help: "Days until our own clients run out of DataCap at the current burn rate",
+			query: `
+				SELECT client, EXTRACT( EPOCH FROM projected_exhaustion - NOW() )::BIGINT / 86400 AS val
+					FROM cargo.client_datacap_projection
+			`,
+		},
+		cargoMetric{
+			kind: cargoMetricGauge,
+			name: "dagcargo_filecoin_client_datacap_replicas_remaining",
+			help: "Amount of aggregate replicas the remaining DataCap of our own clients covers",
+			query: `
+				SELECT client, replicas_remaining AS val
+					FROM cargo.client_datacap_projection
+			`,
+		},
+		cargoMetric{
+			kind: cargoMetricGauge,
+			name: "dagcargo_filecoin_client_datacap_low",
+			help: "Whether the remaining DataCap of our own clients covers fewer than --datacap-low-replicas aggregate replicas",
+			query: `
+				SELECT client, ( replicas_remaining < $1::INTEGER )::INTEGER AS val
+					FROM cargo.client_datacap_projection
+			`,
+			args: func(cctx *cli.Context) []interface{} {
+				return []interface{}{int(cctx.Uint("datacap-low-replicas"))}
+			},
+		},
+	)
+}
+
+// per-provider deal counts from the scorecard kept by track-deals
+func init() {
+	for _, kind := range []string{"published", "activated", "terminated"} {
+		metricsList = append(metricsList, cargoMetric{
+			kind: cargoMetricCounter,
+			name: fmt.Sprintf("dagcargo_provider_deals_%s", kind),
+			help: fmt.Sprintf("Count of deals %s by the provider, as of the last track-deals", kind),
+			query: fmt.Sprintf(
+				`
+				SELECT provider, ( details->'scorecard'->>'deals_%s' )::BIGINT AS val
+					FROM cargo.providers
+				WHERE details ? 'scorecard'
+				`,
+				kind,
+			),
+		})
+	}
+}
+
 // add some templated velocity-window metrics
 func init() {
 	for _, pct := range []int{50, 95} {
@@ -966,8 +1169,8 @@ func init() {
 									EXTRACT(EPOCH FROM
 										PERCENTILE_CONT(0.%d) WITHIN GROUP ( ORDER BY
 											(
-												SELECT MIN( dev.entry_created )
-													FROM cargo.aggregate_entries ae, cargo.deals de, cargo.deal_events dev
+												SELECT MIN( COALESCE( cargo.epoch_to_timestamp( dev.chain_epoch ), dev.entry_created ) )
+													FROM cargo.aggregate_entries ae, cargo.own_deals de, cargo.deal_events dev
 												WHERE
 													ae.cid_v1 = ds.cid_v1
 														AND
@@ -976,6 +1179,8 @@ func init() {
 													de.deal_id = dev.deal_id
 														AND
 													dev.status = 'published'
+														AND
+													NOT dev.reverted
 											) - ds.entry_created
 										)
 									)::INTEGER / 60 AS val
@@ -1023,8 +1228,8 @@ func init() {
 									EXTRACT(EPOCH FROM
 										PERCENTILE_CONT(0.%d) WITHIN GROUP ( ORDER BY
 											(
-												SELECT MIN( dev.entry_created )
-													FROM cargo.aggregate_entries ae, cargo.deals de, cargo.deal_events dev
+												SELECT MIN( COALESCE( cargo.epoch_to_timestamp( dev.chain_epoch ), dev.entry_created ) )
+													FROM cargo.aggregate_entries ae, cargo.own_deals de, cargo.deal_events dev
 												WHERE
 													ae.cid_v1 = ds.cid_v1
 														AND
@@ -1033,6 +1238,8 @@ func init() {
 													de.deal_id = dev.deal_id
 														AND
 													dev.status = 'active'
+														AND
+													NOT dev.reverted
 											) - ds.entry_created
 										)
 									)::INTEGER / 60 AS val
@@ -1184,7 +1391,11 @@ func gatherMetric(cctx *cli.Context, m cargoMetric) ([]prometheus.Collector, err
 		}
 	}
 
-	rows, err := statTx.Query(ctx, m.query)
+	var args []interface{}
+	if m.args != nil {
+		args = m.args(cctx)
+	}
+	rows, err := statTx.Query(ctx, m.query, args...)
 	if err != nil {
 		return nil, err
 	}
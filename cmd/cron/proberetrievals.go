@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/multiformats/go-multiaddr"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+)
+
+type retrievalProbe struct {
+	dealID    int64
+	provider  string
+	pieceCid  string
+	memberCid string
+	url       string
+
+	success       bool
+	httpStatus    *int
+	bytesReceived int64
+	ttfb          *time.Duration
+	duration      time.Duration
+	err           *string
+}
+
+var probeRetrievals = &cli.Command{
+	Usage: "Sample active deals of every provider, and attempt to retrieve them over HTTP",
+	Name:  "probe-retrievals",
+	Flags: []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "provider",
+			Usage: "Only probe these providers (default: all holding active deals)",
+		},
+		&cli.UintFlag{
+			Name:  "deals-per-provider",
+			Usage: "How many random active deals to probe per provider",
+			Value: 3,
+		},
+		&cli.StringFlag{
+			Name:  "method",
+			Usage: "One of: piece ( ranged GET /piece/{PieceCID} ), gateway ( trustless GET /ipfs/{CID} of a random member dag )",
+			Value: "piece",
+		},
+		&cli.StringSliceFlag{
+			Name:  "endpoint",
+			Usage: "PROVIDER=URL to probe instead of the http(s) multiaddr the provider advertises on chain",
+		},
+		&cli.UintFlag{
+			Name:  "timeout-seconds",
+			Usage: "Give up on a single probe after this long",
+			Value: 30,
+		},
+		&cli.Int64Flag{
+			Name:  "probe-bytes",
+			Usage: "Stop reading a response after this many bytes",
+			Value: 1 << 20,
+		},
+		&cli.UintFlag{
+			Name:  "max-concurrent-probes",
+			Value: 8,
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+
+		ctx, closer := context.WithCancel(cctx.Context)
+		defer closer()
+
+		method := cctx.String("method")
+		if method != "piece" && method != "gateway" {
+			return xerrors.Errorf("unknown probe method '%s'", method)
+		}
+
+		overrides := make(map[string]string)
+		for _, e := range cctx.StringSlice("endpoint") {
+			kv := strings.SplitN(e, "=", 2)
+			if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+				return xerrors.Errorf("invalid --endpoint '%s', expected PROVIDER=URL", e)
+			}
+			overrides[kv[0]] = strings.TrimRight(kv[1], "/")
+		}
+
+		var succeeded, failed uint64
+		var providersUpdated int64
+		probes := make([]*retrievalProbe, 0)
+		withoutEndpoint := make(map[string]struct{})
+		defer func() {
+			log.Infow("summary",
+				"method", method,
+				"probes", len(probes),
+				"succeeded", atomic.LoadUint64(&succeeded),
+				"failed", atomic.LoadUint64(&failed),
+				"providersWithoutEndpoint", len(withoutEndpoint),
+				"providersUpdated", providersUpdated,
+			)
+		}()
+
+		rows, err := cargoDb.Query(
+			ctx,
+			`
+			SELECT d.deal_id, d.provider, a.piece_cid,
+					(
+						SELECT ae.cid_v1
+							FROM cargo.aggregate_entries ae
+						WHERE ae.aggregate_cid = d.aggregate_cid
+						ORDER BY RANDOM()
+						LIMIT 1
+					) AS member_cid,
+					COALESCE( p.details->'chain_info'->'multiaddrs', '[]' )
+				FROM (
+					SELECT deal_id, provider, aggregate_cid, ROW_NUMBER() OVER ( PARTITION BY provider ORDER BY RANDOM() ) AS pos
+						FROM cargo.own_deals
+					WHERE
+						status IN ( 'active', 'expiring' )
+							AND
+						( CARDINALITY( $2::TEXT[] ) = 0 OR provider = ANY ( $2::TEXT[] ) )
+				) d
+				JOIN cargo.aggregates a USING ( aggregate_cid )
+				JOIN cargo.providers p USING ( provider )
+			WHERE d.pos <= $1
+			ORDER BY d.provider, d.deal_id
+			`,
+			cctx.Uint("deals-per-provider"),
+			cctx.StringSlice("provider"),
+		)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			pr := new(retrievalProbe)
+			var maddrsJSON []byte
+			if err := rows.Scan(&pr.dealID, &pr.provider, &pr.pieceCid, &pr.memberCid, &maddrsJSON); err != nil {
+				return err
+			}
+
+			base, found := overrides[pr.provider]
+			if !found {
+				var maddrs []string
+				if err := json.Unmarshal(maddrsJSON, &maddrs); err != nil {
+					return err
+				}
+				base = httpEndpointFromMultiaddrs(maddrs)
+			}
+			// nothing to probe is not a failed retrieval: fil-plus-report already
+			// shows whether a provider advertises one at all
+			if base == "" {
+				withoutEndpoint[pr.provider] = struct{}{}
+				continue
+			}
+			if method == "piece" {
+				pr.url = base + "/piece/" + pr.pieceCid
+			} else {
+				pr.url = base + "/ipfs/" + pr.memberCid + "?format=car&dag-scope=block"
+			}
+
+			probes = append(probes, pr)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		rows.Close()
+
+		if len(withoutEndpoint) > 0 {
+			sps := make([]string, 0, len(withoutEndpoint))
+			for sp := range withoutEndpoint {
+				sps = append(sps, sp)
+			}
+			sort.Strings(sps)
+			log.Infow("not probing providers without an http(s) endpoint", "providers", sps)
+		}
+
+		if len(probes) == 0 {
+			return nil
+		}
+		log.Infof("probing %d active deals", len(probes))
+
+		client := newProbeClient()
+
+		todoCh := make(chan *retrievalProbe, len(probes))
+		for _, pr := range probes {
+			todoCh <- pr
+		}
+		close(todoCh)
+
+		var wg sync.WaitGroup
+		for i := uint(0); i < cctx.Uint("max-concurrent-probes"); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for pr := range todoCh {
+					if ctx.Err() != nil {
+						return
+					}
+
+					pctx, pcancel := context.WithTimeout(ctx, time.Duration(cctx.Uint("timeout-seconds"))*time.Second)
+					pr.probe(pctx, client, method, cctx.Int64("probe-bytes"))
+					pcancel()
+
+					if pr.success {
+						atomic.AddUint64(&succeeded, 1)
+					} else {
+						atomic.AddUint64(&failed, 1)
+						log.Warnw("retrieval probe failed", "provider", pr.provider, "deal", pr.dealID, "url", pr.url, "error", *pr.err)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		for _, pr := range probes {
+			target := pr.pieceCid
+			if method == "gateway" {
+				target = pr.memberCid
+			}
+			var ttfbMs *int64
+			if pr.ttfb != nil {
+				ms := pr.ttfb.Milliseconds()
+				ttfbMs = &ms
+			}
+
+			if _, err := cargoDb.Exec(
+				ctx,
+				`
+				INSERT INTO cargo.retrieval_probes ( deal_id, provider, method, target_cid, url, success, http_status, bytes_received, ttfb_ms, duration_ms, error )
+					VALUES ( $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11 )
+				`,
+				pr.dealID,
+				pr.provider,
+				method,
+				target,
+				pr.url,
+				pr.success,
+				pr.httpStatus,
+				pr.bytesReceived,
+				ttfbMs,
+				pr.duration.Milliseconds(),
+				pr.err,
+			); err != nil {
+				return err
+			}
+		}
+
+		res, err := cargoDb.Exec(
+			ctx,
+			`
+			UPDATE cargo.providers p SET
+				details = JSONB_SET(
+					COALESCE( p.details, '{}' ),
+					'{retrieval}',
+					( TO_JSONB( s ) - 'provider' ) || JSONB_BUILD_OBJECT( 'computed_at', NOW() )
+				)
+			FROM cargo.provider_retrieval_summary s
+			WHERE p.provider = s.provider
+			`,
+		)
+		if err != nil {
+			return err
+		}
+		providersUpdated = res.RowsAffected()
+
+		return nil
+	},
+}
+
+// a provider redirecting elsewhere still counts as serving
+func newProbeClient() *http.Client {
+	return &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 3 {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+}
+
+// probe fetches up to maxBytes from pr.url, recording how long the headers and
+// the body took. Anything but a 200/206 with a non-empty body is a failure.
+func (pr *retrievalProbe) probe(ctx context.Context, client *http.Client, method string, maxBytes int64) {
+	t0 := time.Now()
+	defer func() { pr.duration = time.Since(t0) }()
+
+	fail := func(err error) {
+		m := err.Error()
+		pr.err = &m
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pr.url, nil)
+	if err != nil {
+		fail(err)
+		return
+	}
+	if method == "piece" {
+		req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", maxBytes-1))
+	} else {
+		req.Header.Set("Accept", "application/vnd.ipld.car")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	ttfb := time.Since(t0)
+	pr.ttfb = &ttfb
+	pr.httpStatus = &resp.StatusCode
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		fail(xerrors.Errorf("unexpected HTTP status '%s'", resp.Status))
+		return
+	}
+
+	pr.bytesReceived, err = io.Copy(io.Discard, io.LimitReader(resp.Body, maxBytes))
+	if err != nil {
+		fail(xerrors.Errorf("reading body failed after %d bytes: %w", pr.bytesReceived, err))
+		return
+	}
+	if pr.bytesReceived == 0 {
+		fail(xerrors.New("empty response body"))
+		return
+	}
+
+	pr.success = true
+}
+
+// httpEndpointFromMultiaddrs returns the first http(s) endpoint among the
+// multiaddrs a provider advertises on chain, as a base URL
+func httpEndpointFromMultiaddrs(maddrs []string) string {
+	for _, s := range maddrs {
+		if u, err := urlFromMultiaddr(s, ""); err == nil && u != "" {
+			return u
+		}
+	}
+	return ""
+}
+
+// urlFromMultiaddr turns a host/tcp/http(s) multiaddr into a base URL. Without
+// an http(s) component defaultScheme is used, and an empty one means no URL.
+func urlFromMultiaddr(s string, defaultScheme string) (string, error) {
+	ma, err := multiaddr.NewMultiaddr(s)
+	if err != nil {
+		return "", err
+	}
+
+	var host, port string
+	scheme := defaultScheme
+	multiaddr.ForEach(ma, func(c multiaddr.Component) bool {
+		switch c.Protocol().Code {
+		case multiaddr.P_IP4, multiaddr.P_DNS, multiaddr.P_DNS4, multiaddr.P_DNS6:
+			host = c.Value()
+		case multiaddr.P_IP6:
+			host = "[" + c.Value() + "]"
+		case multiaddr.P_TCP:
+			port = c.Value()
+		case multiaddr.P_HTTP:
+			scheme = "http"
+		case multiaddr.P_HTTPS:
+			scheme = "https"
+		}
+		return true
+	})
+
+	if host == "" || scheme == "" {
+		return "", nil
+	}
+	if port != "" {
+		host += ":" + port
+	}
+	return scheme + "://" + host, nil
+}
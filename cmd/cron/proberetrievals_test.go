@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func runProbe(t *testing.T, url, method string, maxBytes int64, timeout time.Duration) *retrievalProbe {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	pr := &retrievalProbe{url: url}
+	pr.probe(ctx, newProbeClient(), method, maxBytes)
+
+	if pr.success != (pr.err == nil) {
+		t.Errorf("success %t does not match error %v", pr.success, pr.err)
+	}
+	if pr.duration <= 0 {
+		t.Errorf("probe duration not recorded")
+	}
+	return pr
+}
+
+func TestRetrievalProbe(t *testing.T) {
+	payload := bytes.Repeat([]byte{0xCA}, 4096)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/full", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(payload) //nolint:errcheck
+	})
+	mux.HandleFunc("/ranged", func(w http.ResponseWriter, r *http.Request) {
+		var from, to int
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &from, &to); err != nil {
+			http.Error(w, "range required", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", from, to, len(payload)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(payload[from : to+1]) //nolint:errcheck
+	})
+	mux.HandleFunc("/car", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != "application/vnd.ipld.car" {
+			http.Error(w, "car only", http.StatusNotAcceptable)
+			return
+		}
+		w.Write(payload) //nolint:errcheck
+	})
+	mux.HandleFunc("/missing", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no such piece", http.StatusNotFound)
+	})
+	mux.HandleFunc("/empty", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/stall", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+	mux.HandleFunc("/hop/", func(w http.ResponseWriter, r *http.Request) {
+		var n int
+		fmt.Sscanf(strings.TrimPrefix(r.URL.Path, "/hop/"), "%d", &n) //nolint:errcheck
+		if n <= 0 {
+			http.Redirect(w, r, "/full", http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/hop/%d", n-1), http.StatusFound)
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		name      string
+		path      string
+		method    string
+		maxBytes  int64
+		timeout   time.Duration
+		success   bool
+		status    int // 0 for no response at all
+		bytes     int64
+		errSubstr string
+	}{
+		{name: "full body", path: "/full", method: "piece", maxBytes: 1 << 20, success: true, status: 200, bytes: 4096},
+		{name: "read stops at max bytes", path: "/full", method: "piece", maxBytes: 100, success: true, status: 200, bytes: 100},
+		{name: "ranged piece", path: "/ranged", method: "piece", maxBytes: 1024, success: true, status: 206, bytes: 1024},
+		{name: "gateway asks for a car", path: "/car", method: "gateway", maxBytes: 1 << 20, success: true, status: 200, bytes: 4096},
+		{name: "error status", path: "/missing", method: "piece", maxBytes: 1 << 20, status: 404, errSubstr: "404"},
+		{name: "empty body", path: "/empty", method: "piece", maxBytes: 1 << 20, status: 200, errSubstr: "empty response body"},
+		{name: "timeout", path: "/stall", method: "piece", maxBytes: 1 << 20, timeout: 50 * time.Millisecond, errSubstr: "deadline exceeded"},
+		{name: "redirects followed", path: "/hop/1", method: "piece", maxBytes: 1 << 20, success: true, status: 200, bytes: 4096},
+		{name: "too many redirects", path: "/hop/5", method: "piece", maxBytes: 1 << 20, status: 302, errSubstr: "302"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			timeout := tc.timeout
+			if timeout == 0 {
+				timeout = 5 * time.Second
+			}
+			pr := runProbe(t, srv.URL+tc.path, tc.method, tc.maxBytes, timeout)
+
+			if pr.success != tc.success {
+				t.Fatalf("expected success %t, got %t ( error: %v )", tc.success, pr.success, pr.err)
+			}
+			if tc.status == 0 {
+				if pr.httpStatus != nil || pr.ttfb != nil {
+					t.Errorf("expected no response, got status %d", *pr.httpStatus)
+				}
+			} else if pr.httpStatus == nil || *pr.httpStatus != tc.status {
+				t.Errorf("expected status %d, got %v", tc.status, pr.httpStatus)
+			} else if pr.ttfb == nil {
+				t.Errorf("time to first byte not recorded")
+			}
+			if pr.bytesReceived != tc.bytes {
+				t.Errorf("expected %d bytes, got %d", tc.bytes, pr.bytesReceived)
+			}
+			if tc.errSubstr != "" && (pr.err == nil || !strings.Contains(*pr.err, tc.errSubstr)) {
+				t.Errorf("expected an error containing '%s', got %v", tc.errSubstr, pr.err)
+			}
+		})
+	}
+}
+
+func TestHTTPEndpointFromMultiaddrs(t *testing.T) {
+	for _, tc := range []struct {
+		maddrs   []string
+		expected string
+	}{
+		{nil, ""},
+		{[]string{"/ip4/10.0.0.1/tcp/24001"}, ""},
+		{[]string{"/ip4/10.0.0.1/tcp/8080/http"}, "http://10.0.0.1:8080"},
+		{[]string{"/dns/sp.example.com/tcp/443/https"}, "https://sp.example.com:443"},
+		{[]string{"/dns4/sp.example.com/https"}, "https://sp.example.com"},
+		{[]string{"/ip6/2001:db8::1/tcp/80/http"}, "http://[2001:db8::1]:80"},
+		{[]string{"not a multiaddr", "/ip4/10.0.0.1/tcp/24001", "/ip4/10.0.0.2/tcp/80/http", "/ip4/10.0.0.3/tcp/80/http"}, "http://10.0.0.2:80"},
+	} {
+		if got := httpEndpointFromMultiaddrs(tc.maddrs); got != tc.expected {
+			t.Errorf("%v: expected '%s', got '%s'", tc.maddrs, tc.expected, got)
+		}
+	}
+}
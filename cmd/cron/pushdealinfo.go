@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+)
+
+// push-deal-info expects the upstream table from maint/pg_upstream_deal_info.sql
+// to exist in the deal-info database of every project it pushes to
+
+// persisted in cargo.runtime_state between runs, one per project
+type dealInfoPushState struct {
+	LastUpdated time.Time `json:"last_updated"`
+	LastDealID  int64     `json:"last_deal_id"`
+	LastCid     string    `json:"last_content_cid"`
+}
+
+// deals updated while a previous run was reading may carry an earlier timestamp
+// than what it got to: re-pushing a little of the past is harmless
+const dealInfoPushOverlap = 15 * time.Minute
+
+var pushDealInfo = &cli.Command{
+	Usage: "Upsert aggregate and deal info of every dag into the upstream database of its project",
+	Name:  "push-deal-info",
+	Flags: []cli.Flag{
+		&cli.IntSliceFlag{
+			Name:     "project",
+			Usage:    "List of project ids to push to",
+			Required: true,
+		},
+		&cli.UintFlag{
+			Name:  "batch-size",
+			Usage: "How many dag/deal rows to push per upstream upsert",
+			Value: 5000,
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+
+		ctx, closer := context.WithCancel(cctx.Context)
+		defer closer()
+
+		requested := make(map[int]struct{})
+		for _, v := range cctx.IntSlice("project") {
+			if _, known := projects[fmt.Sprintf("%d", v)]; !known {
+				return xerrors.Errorf("unknown project '%d'", v)
+			}
+			requested[v] = struct{}{}
+		}
+
+		pushedDeals := make(map[string]int)
+		pushedRows := make(map[string]int64)
+		defer func() {
+			log.Infow("summary",
+				"pushedDeals", pushedDeals,
+				"upsertedRows", pushedRows,
+			)
+		}()
+
+		for _, p := range pgProjects {
+			if _, req := requested[p.id]; !req {
+				continue
+			}
+			if p.dealInfoPgConnString == "" || p.dealInfoTable == "" {
+				return xerrors.Errorf("project %s (%d) has no deal-info destination configured", p.label, p.id)
+			}
+
+			deals, rows, err := p.pushDealInfo(ctx, cctx.Uint("batch-size"))
+			pushedDeals[p.label] = deals
+			pushedRows[p.label] = rows
+			if err != nil {
+				return xerrors.Errorf("pushing deal info to project %s (%d) failed: %w", p.label, p.id, err)
+			}
+		}
+
+		return nil
+	},
+}
+
+func (p pgProject) pushDealInfo(ctx context.Context, batchSize uint) (int, int64, error) {
+	stateKey := fmt.Sprintf("push-deal-info-%d", p.id)
+
+	var state dealInfoPushState
+	haveState, err := loadRuntimeState(ctx, stateKey, &state)
+	if err != nil {
+		return 0, 0, err
+	}
+	if haveState {
+		state.LastUpdated = state.LastUpdated.Add(-dealInfoPushOverlap)
+		state.LastDealID = 0
+		state.LastCid = ""
+	}
+
+	dstConn, err := pgxpool.ParseConfig(p.dealInfoPgConnString)
+	if err != nil {
+		return 0, 0, err
+	}
+	dstDb, err := pgxpool.ConnectConfig(ctx, dstConn)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer dstDb.Close()
+
+	upsertSQL := fmt.Sprintf(
+		`
+		INSERT INTO %[1]s ( content_cid, aggregate_cid, piece_cid, deal_id, provider, status, deal_start, deal_end, updated_at )
+			SELECT u.*, NOW()
+				FROM UNNEST( $1::TEXT[], $2::TEXT[], $3::TEXT[], $4::BIGINT[], $5::TEXT[], $6::TEXT[], $7::TIMESTAMP WITH TIME ZONE[], $8::TIMESTAMP WITH TIME ZONE[] ) u
+		ON CONFLICT ( content_cid, deal_id ) DO UPDATE SET
+			aggregate_cid = EXCLUDED.aggregate_cid,
+			piece_cid = EXCLUDED.piece_cid,
+			provider = EXCLUDED.provider,
+			status = EXCLUDED.status,
+			deal_start = EXCLUDED.deal_start,
+			deal_end = EXCLUDED.deal_end,
+			updated_at = EXCLUDED.updated_at
+		WHERE
+			%[1]s.status IS DISTINCT FROM EXCLUDED.status
+				OR
+			%[1]s.deal_end IS DISTINCT FROM EXCLUDED.deal_end
+		`,
+		pgx.Identifier(strings.Split(p.dealInfoTable, ".")).Sanitize(),
+	)
+
+	var totalDeals int
+	var totalRows int64
+	lastDeal := state.LastDealID
+	for {
+		// keyset over the dags of this project in changed own deals: a deal of a
+		// large aggregate can span many batches, and resumes where it left off
+		var contentCids, aggCids, pieceCids, providers, statuses []string
+		var dealIDs []int64
+		var starts, ends []time.Time
+		next := state
+		rows, err := cargoDb.Query(
+			ctx,
+			`
+			SELECT d.entry_last_updated, d.deal_id, ae.cid_v1, d.aggregate_cid, a.piece_cid, d.provider, d.status, d.start_time, d.end_time
+				FROM cargo.own_deals d
+				JOIN cargo.aggregates a USING ( aggregate_cid )
+				JOIN cargo.aggregate_entries ae USING ( aggregate_cid )
+			WHERE
+				( d.entry_last_updated, d.deal_id, ae.cid_v1 ) > ( $1, $2, $3 )
+					AND
+				EXISTS (
+					SELECT 42
+						FROM cargo.dag_sources ds
+						JOIN cargo.sources s USING ( srcid )
+					WHERE ds.cid_v1 = ae.cid_v1 AND ds.entry_removed IS NULL AND s.project = $4
+				)
+			ORDER BY d.entry_last_updated, d.deal_id, ae.cid_v1
+			LIMIT $5
+			`,
+			state.LastUpdated,
+			state.LastDealID,
+			state.LastCid,
+			p.id,
+			batchSize,
+		)
+		if err != nil {
+			return totalDeals, totalRows, err
+		}
+		for rows.Next() {
+			var contentCid, aggCid, pieceCid, provider, status string
+			var dealID int64
+			var start, end time.Time
+			if err := rows.Scan(&next.LastUpdated, &dealID, &contentCid, &aggCid, &pieceCid, &provider, &status, &start, &end); err != nil {
+				rows.Close()
+				return totalDeals, totalRows, err
+			}
+			next.LastDealID = dealID
+			next.LastCid = contentCid
+			if dealID != lastDeal {
+				totalDeals++
+				lastDeal = dealID
+			}
+			contentCids = append(contentCids, contentCid)
+			aggCids = append(aggCids, aggCid)
+			pieceCids = append(pieceCids, pieceCid)
+			dealIDs = append(dealIDs, dealID)
+			providers = append(providers, provider)
+			statuses = append(statuses, status)
+			starts = append(starts, start)
+			ends = append(ends, end)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return totalDeals, totalRows, err
+		}
+
+		if len(contentCids) == 0 {
+			return totalDeals, totalRows, nil
+		}
+
+		res, err := dstDb.Exec(ctx, upsertSQL, contentCids, aggCids, pieceCids, dealIDs, providers, statuses, starts, ends)
+		if err != nil {
+			return totalDeals, totalRows, err
+		}
+
+		// only move the watermark once upstream has the batch
+		if err := saveRuntimeState(ctx, stateKey, next); err != nil {
+			return totalDeals, totalRows, err
+		}
+		state = next
+		totalRows += res.RowsAffected()
+
+		log.Infow("pushed deal info batch", "project", p.label, "rows", len(contentCids), "upsertedRows", res.RowsAffected(), "through", state.LastUpdated)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/filecoin-project/go-dagaggregator-unixfs"
+	"github.com/filecoin-project/go-dagaggregator-unixfs/lib/rambs"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	exchangeoffline "github.com/ipfs/go-ipfs-exchange-offline"
+	"github.com/ipfs/go-merkledag"
+	"github.com/jackc/pgx/v4"
+	"github.com/mitchellh/go-homedir"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+)
+
+var rebuildAggregate = &cli.Command{
+	Usage:     "Deterministically re-export a previously recorded aggregate from its database records",
+	Name:      "rebuild-aggregate",
+	ArgsUsage: "<aggregate_cid>",
+	Flags: []cli.Flag{
+		&cli.PathFlag{
+			Required: true,
+			Name:     "export-dir",
+			Usage:    "A pre-existing directory with sufficient space to export the .car file into",
+		},
+		&cli.BoolFlag{
+			Name:  "skip-pinning",
+			Usage: "do not pin the rebuilt aggregate - rely on out-of-band advertisers",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		if cctx.Args().Len() != 1 {
+			return xerrors.New("exactly one aggregate_cid must be specified")
+		}
+		aggCid, err := cid.Parse(cctx.Args().First())
+		if err != nil {
+			return err
+		}
+
+		outDir, err := homedir.Expand(cctx.Path("export-dir"))
+		if err != nil {
+			return err
+		}
+		if st, err := os.Stat(outDir); err != nil || !st.IsDir() {
+			if err == nil {
+				err = xerrors.Errorf("filemode %s is not a directory", st.Mode().String())
+			}
+			return xerrors.Errorf("check of '%s' failed: %w", outDir, err)
+		}
+
+		fn, err := rebuildAggregateCar(cctx, cidv1(aggCid), outDir, !cctx.Bool("skip-pinning"))
+		if err != nil {
+			return err
+		}
+
+		log.Infow("summary", "aggregate", cidv1(aggCid).String(), "rebuiltCar", fn)
+		return nil
+	},
+}
+
+type recordedAggregate struct {
+	pieceCid    cid.Cid
+	exportSize  uint64
+	pieceSize   filabi.PaddedPieceSize
+	md5hex      string
+	sha256hex   string
+	isTimeboxed bool
+}
+
+// reassembleAggregate reconstructs the in-memory aggregate structure from
+// cargo.aggregate_entries, ensuring it matches the recorded root and selectors.
+// The size and hash fields of the result are populated from the database.
+func reassembleAggregate(ctx context.Context, aggCid cid.Cid) (*aggregateResult, *rambs.RamBs, *recordedAggregate, error) {
+
+	rec := new(recordedAggregate)
+	var pieceCidStr string
+	err := cargoDb.QueryRow(
+		ctx,
+		`
+		SELECT piece_cid, export_size, piece_size, metadata->>'md5hex', metadata->>'sha256hex', COALESCE( (metadata->'timeboxed')::BOOLEAN, false )
+			FROM cargo.aggregates
+		WHERE aggregate_cid = $1
+		`,
+		aggCid.String(),
+	).Scan(&pieceCidStr, &rec.exportSize, &rec.pieceSize, &rec.md5hex, &rec.sha256hex, &rec.isTimeboxed)
+	if err == pgx.ErrNoRows {
+		return nil, nil, nil, xerrors.Errorf("aggregate %s is not known", aggCid)
+	} else if err != nil {
+		return nil, nil, nil, err
+	}
+	if rec.pieceCid, err = cid.Parse(pieceCidStr); err != nil {
+		return nil, nil, nil, err
+	}
+
+	toAgg := make([]dagaggregator.AggregateDagEntry, 0, 1<<10)
+	recordedSelectors := make(map[string]string, 1<<10)
+	err = cargoDb.BeginTxFunc(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly}, func(rotx pgx.Tx) error {
+
+		_, err := rotx.Exec(ctx, fmt.Sprintf(`SET LOCAL statement_timeout = %d`, (2*time.Hour).Milliseconds()))
+		if err != nil {
+			return err
+		}
+
+		// standalone roots first, then everything that was included "for free" via them
+		rows, err := rotx.Query(
+			ctx,
+			`
+			SELECT
+					d.cid_v1,
+					d.size_actual,
+					( SELECT 1+COUNT(*) FROM cargo.refs sr WHERE sr.cid_v1 = d.cid_v1 ) AS node_count,
+					ae.datamodel_selector,
+					EXISTS (
+						SELECT 42
+							FROM cargo.refs r
+							JOIN cargo.aggregate_entries pae
+								ON r.cid_v1 = pae.cid_v1 AND pae.aggregate_cid = ae.aggregate_cid
+						WHERE r.ref_cid = ae.cid_v1
+					) AS is_included
+				FROM cargo.aggregate_entries ae
+				JOIN cargo.dags d USING ( cid_v1 )
+			WHERE ae.aggregate_cid = $1
+			ORDER BY is_included, d.size_actual DESC, d.cid_v1
+			`,
+			aggCid.String(),
+		)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var e dagaggregator.AggregateDagEntry
+			var cidStr, selector string
+			var isIncluded bool
+			if err = rows.Scan(&cidStr, &e.UniqueBlockCumulativeSize, &e.UniqueBlockCount, &selector, &isIncluded); err != nil {
+				return err
+			}
+			if e.RootCid, err = cid.Parse(cidStr); err != nil {
+				return err
+			}
+			toAgg = append(toAgg, e)
+			recordedSelectors[cidStr] = selector
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(toAgg) == 0 {
+		return nil, nil, nil, xerrors.Errorf("aggregate %s has no recorded entries", aggCid)
+	}
+
+	ramBs := new(rambs.RamBs)
+	ramDs := merkledag.NewDAGService(blockservice.New(ramBs, exchangeoffline.Exchange(ramBs)))
+
+	res := &aggregateResult{
+		standaloneEntries: toAgg,
+		carSize:           rec.exportSize,
+		carPieceSize:      rec.pieceSize,
+		carCommp:          rec.pieceCid,
+	}
+	if res.carMd5, err = hex.DecodeString(rec.md5hex); err != nil {
+		return nil, nil, nil, err
+	}
+	if res.carSha256, err = hex.DecodeString(rec.sha256hex); err != nil {
+		return nil, nil, nil, err
+	}
+
+	res.carRoot, res.manifestEntries, err = dagaggregator.Aggregate(ctx, ramDs, toAgg)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if !res.carRoot.Equals(aggCid) {
+		return nil, nil, nil, xerrors.Errorf("reassembled aggregate root %s does not match requested %s", res.carRoot, aggCid)
+	}
+	for _, e := range res.manifestEntries {
+		if sel := manifestEntrySelector(e); sel != recordedSelectors[e.DagCidV1] {
+			return nil, nil, nil, xerrors.Errorf("reassembled selector '%s' for %s does not match recorded '%s'", sel, e.DagCidV1, recordedSelectors[e.DagCidV1])
+		}
+	}
+
+	return res, ramBs, rec, nil
+}
+
+// rebuildAggregateCar re-exports a reassembled aggregate and links the result
+// into outDir only if it reproduces the recorded piece
+func rebuildAggregateCar(cctx *cli.Context, aggCid cid.Cid, outDir string, pin bool) (string, error) {
+	ctx, ctxCloser := context.WithCancel(cctx.Context)
+	defer ctxCloser()
+
+	// cheap checks before we spend hours exporting
+	res, ramBs, rec, err := reassembleAggregate(ctx, aggCid)
+	if err != nil {
+		return "", err
+	}
+
+	fn := fmt.Sprintf("%s/%s", outDir, aggregateCarName(rec.md5hex, rec.pieceCid.String()))
+	if _, err := os.Stat(fn); err == nil {
+		return "", xerrors.Errorf("car file %s already exists", fn)
+	}
+
+	aggLabel := fmt.Sprintf("rebuild of aggregate %s dagcount %d", res.carRoot, len(res.manifestEntries))
+
+	log.Infof("%s: writing out intermediate blocks to ipfs daemon", aggLabel)
+	if err = writeoutBlocks(cctx, ramBs); err != nil {
+		return "", err
+	}
+
+	log.Infof("%s: writing out expected %s bytes as car export, calculating commP and other hashes", aggLabel, humanize.Comma(int64(rec.exportSize)))
+
+	api := ipfsAPI(cctx)
+	api.SetTimeout(16 * time.Hour)
+
+	toUnpinOnError := ""
+	if pin {
+		toUnpinOnError = res.carRoot.String()
+		defer func() {
+			if toUnpinOnError != "" {
+				msg := fmt.Sprintf("unpinning %s after unsuccessful rebuild", toUnpinOnError)
+				err := api.Request("pin/rm").Arguments(toUnpinOnError).Option("offline", true).Exec(context.Background(), nil) // non-interruptable context
+				if err != nil {
+					msg += " failed: " + err.Error()
+				}
+				log.Warn(msg)
+			}
+		}()
+	}
+
+	carTmpFile, err := exportCarFile(cctx, api, outDir, res, pin, nil)
+	if err != nil {
+		return "", err
+	}
+	defer carTmpFile.Close() //nolint:errcheck
+
+	if !res.carCommp.Equals(rec.pieceCid) {
+		return "", xerrors.Errorf("%s: rebuilt commP %s does not match recorded piece_cid %s", aggLabel, res.carCommp, rec.pieceCid)
+	}
+	if res.carSize != rec.exportSize {
+		return "", xerrors.Errorf("%s: rebuilt car size %d does not match recorded export_size %d", aggLabel, res.carSize, rec.exportSize)
+	}
+	if fmt.Sprintf("%x", res.carMd5) != rec.md5hex {
+		return "", xerrors.Errorf("%s: rebuilt car md5 %x does not match recorded %s", aggLabel, res.carMd5, rec.md5hex)
+	}
+
+	toUnpinOnError = ""
+
+	fn, err = reifyCarFile(carTmpFile, outDir, res)
+	if err != nil {
+		return "", err
+	}
+
+	log.Infof("%s: commP %s verified, reified %s bytes at %s", aggLabel, res.carCommp, humanize.Comma(int64(res.carSize)), fn)
+
+	if _, err := writeManifestSidecar(outDir, res, rec.isTimeboxed); err != nil {
+		return "", xerrors.Errorf("%s: failed writing manifest sidecar: %w", aggLabel, err)
+	}
+
+	return fn, nil
+}
+
+func manifestEntrySelector(e *dagaggregator.ManifestDagEntry) string {
+	return fmt.Sprintf("Links/%d/Hash/Links/%d/Hash/Links/%d/Hash", e.PathIndexes[0], e.PathIndexes[1], e.PathIndexes[2])
+}
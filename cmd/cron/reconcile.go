@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	fslock "github.com/ipfs/go-fs-lock"
+	"github.com/mitchellh/go-homedir"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+)
+
+type reconcileAggregate struct {
+	aggregateCid cid.Cid
+	pieceCid     string
+	md5hex       string
+	hasLocalCar  bool
+	hasManifest  bool
+}
+
+const recordlessPinsStateKey = "reconcile-recordless-pins"
+
+var reconcile = &cli.Command{
+	Usage: "Inventory the export dir, ipfs pins and aggregate records, reporting and optionally fixing inconsistencies",
+	Name:  "reconcile",
+	Flags: []cli.Flag{
+		&cli.PathFlag{
+			Required: true,
+			Name:     "export-dir",
+			Usage:    "The directory aggregate-dags exports .car files into",
+		},
+		&cli.BoolFlag{
+			Name:  "check-offload",
+			Usage: "Probe aggregate-location-template for every aggregate not present in export-dir",
+		},
+		&cli.UintFlag{
+			Name:  "stray-min-age-hours",
+			Usage: "Only consider temporary files stray after they have not been modified for that many hours",
+			Value: 24,
+		},
+		&cli.BoolFlag{
+			Name:  "fix-unpin",
+			Usage: "Unpin recursive pins that have been neither a known dag nor a known aggregate for unpin-grace-hours",
+		},
+		&cli.UintFlag{
+			Name:  "unpin-grace-hours",
+			Usage: "Only unpin a recursive pin after it has been seen without a record for that many hours",
+			Value: 24,
+		},
+		&cli.BoolFlag{
+			Name:  "fix-remove-strays",
+			Usage: "Delete stray temporary files and manifests without a matching aggregate",
+		},
+		&cli.BoolFlag{
+			Name:  "fix-relink",
+			Usage: "Regenerate missing manifest sidecars, and rebuild aggregates missing both locally and from offload (requires --check-offload)",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+
+		ctx, closer := context.WithCancel(cctx.Context)
+		defer closer()
+
+		outDir, err := homedir.Expand(cctx.Path("export-dir"))
+		if err != nil {
+			return err
+		}
+
+		// do not race an in-progress aggregation: it pins roots and moves its files
+		// into place before recording them
+		if cctx.Bool("fix-unpin") || cctx.Bool("fix-relink") || cctx.Bool("fix-remove-strays") {
+			aggLock, err := fslock.Lock(os.TempDir(), "cargocron-"+aggregateDags.Name)
+			if err != nil {
+				return xerrors.Errorf("unable to obtain exlock for %s: %w", aggregateDags.Name, err)
+			}
+			defer aggLock.Close() //nolint:errcheck
+		}
+
+		issues := make(map[string]int)
+		var fixed, fixFailed int
+		defer func() {
+			log.Infow("summary",
+				"inconsistencies", issues,
+				"fixed", fixed,
+				"fixFailed", fixFailed,
+			)
+		}()
+		report := func(class string, kv ...interface{}) {
+			issues[class]++
+			log.Warnw("inconsistency: "+class, kv...)
+		}
+		fixResult := func(what string, err error) {
+			if err != nil {
+				fixFailed++
+				log.Errorf("fix of %s failed: %s", what, err)
+			} else {
+				fixed++
+				log.Infof("fixed %s", what)
+			}
+		}
+
+		//
+		// database inventory
+		aggs := make(map[string]*reconcileAggregate, 1<<10)
+		knownAggregateRoots := make(map[cid.Cid]struct{}, 1<<10)
+		rows, err := cargoDb.Query(
+			ctx,
+			`SELECT aggregate_cid, piece_cid, metadata->>'md5hex' FROM cargo.aggregates`,
+		)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			a := new(reconcileAggregate)
+			var aCidStr string
+			if err = rows.Scan(&aCidStr, &a.pieceCid, &a.md5hex); err != nil {
+				return err
+			}
+			if a.aggregateCid, err = cid.Parse(aCidStr); err != nil {
+				return err
+			}
+			aggs[a.md5hex+"_"+a.pieceCid] = a
+			knownAggregateRoots[cidv1(a.aggregateCid)] = struct{}{}
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		//
+		// export-dir inventory
+		dirEntries, err := os.ReadDir(outDir)
+		if err != nil {
+			return err
+		}
+		strayCutoff := time.Now().Add(-1 * time.Hour * time.Duration(cctx.Uint("stray-min-age-hours")))
+		for _, de := range dirEntries {
+			name := de.Name()
+			fn := outDir + "/" + name
+
+			if de.IsDir() {
+				continue
+			}
+
+			if strings.HasPrefix(name, ".") {
+				fi, err := de.Info()
+				if err != nil {
+					return err
+				}
+				if fi.ModTime().After(strayCutoff) {
+					continue
+				}
+				report("strayTempFile", "file", fn, "lastModified", fi.ModTime())
+				if cctx.Bool("fix-remove-strays") {
+					fixResult("stray "+fn, os.Remove(fn))
+				}
+				continue
+			}
+
+			if strings.HasSuffix(name, ".car") {
+				if a, known := aggs[strings.TrimSuffix(name, ".car")]; known {
+					a.hasLocalCar = true
+				} else {
+					// never automatically removed: might be the only copy of something we failed to record
+					report("carWithoutAggregateRecord", "file", fn)
+				}
+				continue
+			}
+
+			if strings.HasSuffix(name, manifestSidecarSuffix) {
+				if a, known := aggs[strings.TrimSuffix(name, manifestSidecarSuffix)]; known {
+					a.hasManifest = true
+				} else {
+					report("manifestWithoutAggregateRecord", "file", fn)
+					if cctx.Bool("fix-remove-strays") {
+						fixResult("stray "+fn, os.Remove(fn))
+					}
+				}
+				continue
+			}
+
+			report("unexpectedFile", "file", fn)
+		}
+
+		//
+		// aggregates without local files
+		notLocal := make([]*reconcileAggregate, 0, len(aggs))
+		for _, a := range aggs {
+			if !a.hasLocalCar {
+				notLocal = append(notLocal, a)
+			} else if !a.hasManifest {
+				report("aggregateWithoutManifest", "aggregate", a.aggregateCid.String())
+				if cctx.Bool("fix-relink") {
+					fixResult("manifest of "+a.aggregateCid.String(), func() error {
+						res, _, rec, err := reassembleAggregate(ctx, a.aggregateCid)
+						if err != nil {
+							return err
+						}
+						_, err = writeManifestSidecar(outDir, res, rec.isTimeboxed)
+						return err
+					}())
+				}
+			}
+		}
+
+		if cctx.Bool("check-offload") && len(notLocal) > 0 {
+			log.Infof("probing offload location of %d aggregates not present in %s", len(notLocal), outDir)
+			missing, err := aggregatesNotOffloaded(cctx, notLocal)
+			if err != nil {
+				return err
+			}
+			for _, a := range missing {
+				report("aggregateNeverOffloaded", "aggregate", a.aggregateCid.String(), "piece", a.pieceCid)
+				if cctx.Bool("fix-relink") {
+					_, err := rebuildAggregateCar(cctx, a.aggregateCid, outDir, false)
+					fixResult("car of "+a.aggregateCid.String(), err)
+				}
+			}
+		}
+
+		//
+		// pins neither in dags nor aggregates
+		systemPins, err := recursivePins(cctx)
+		if err != nil {
+			return err
+		}
+		knownDags, err := cidListFromQuery(ctx, `SELECT cid_v1 FROM cargo.dags`)
+		if err != nil {
+			return err
+		}
+		// get-new-dags and pin_sweep may pin before the record lands: remember
+		// since when a pin has been recordless, and leave the young ones be
+		var prevRecordless map[string]time.Time
+		if _, err := loadRuntimeState(ctx, recordlessPinsStateKey, &prevRecordless); err != nil {
+			return err
+		}
+		recordless := make(map[string]time.Time)
+		api := ipfsAPI(cctx)
+		for c := range systemPins {
+			if _, known := knownDags[c]; known {
+				continue
+			}
+			if _, known := knownAggregateRoots[c]; known {
+				continue
+			}
+			firstSeen, seen := prevRecordless[c.String()]
+			if !seen {
+				firstSeen = time.Now()
+			}
+			recordless[c.String()] = firstSeen
+
+			report("pinWithoutRecord", "cid", c.String(), "since", firstSeen)
+			if cctx.Bool("fix-unpin") && time.Since(firstSeen) >= time.Duration(cctx.Uint("unpin-grace-hours"))*time.Hour {
+				err := api.Request("pin/rm").Arguments(c.String()).Option("offline", true).Exec(ctx, nil)
+				if err == nil {
+					delete(recordless, c.String())
+				}
+				fixResult("pin "+c.String(), err)
+			}
+		}
+		if err := saveRuntimeState(ctx, recordlessPinsStateKey, recordless); err != nil {
+			return err
+		}
+
+		if fixFailed > 0 {
+			return xerrors.Errorf("%d fix attempts failed", fixFailed)
+		}
+		return ctx.Err()
+	},
+}
+
+func aggregatesNotOffloaded(cctx *cli.Context, aggs []*reconcileAggregate) ([]*reconcileAggregate, error) {
+
+	client := retryingClient("")
+	todoCh := make(chan *reconcileAggregate, len(aggs))
+	for _, a := range aggs {
+		todoCh <- a
+	}
+	close(todoCh)
+
+	var mu sync.Mutex
+	var firstErr error
+	missing := make([]*reconcileAggregate, 0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for a := range todoCh {
+				found, err := func() (bool, error) {
+					loc, err := aggregateLocation(cctx, a.aggregateCid.String(), a.pieceCid, a.md5hex)
+					if err != nil {
+						return false, err
+					}
+					req, err := http.NewRequestWithContext(cctx.Context, http.MethodHead, loc, nil)
+					if err != nil {
+						return false, err
+					}
+					resp, err := client.Do(req)
+					if err != nil {
+						return false, err
+					}
+					resp.Body.Close() //nolint:errcheck
+					switch resp.StatusCode {
+					case http.StatusOK:
+						return true, nil
+					case http.StatusNotFound, http.StatusForbidden:
+						return false, nil
+					default:
+						return false, xerrors.Errorf("unexpected HTTP status '%s' from %s", resp.Status, loc)
+					}
+				}()
+
+				mu.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = xerrors.Errorf("probing offload of %s failed: %w", a.aggregateCid, err)
+					}
+				} else if !found {
+					missing = append(missing, a)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return missing, cctx.Context.Err()
+}
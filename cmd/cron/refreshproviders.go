@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	filaddr "github.com/filecoin-project/go-address"
+	lotusapi "github.com/filecoin-project/lotus/api"
+	filtypes "github.com/filecoin-project/lotus/chain/types"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+)
+
+type providerChainInfo struct {
+	Owner            string          `json:"owner"`
+	Worker           string          `json:"worker"`
+	WorkerKey        string          `json:"worker_key"`
+	ControlAddresses []string        `json:"control_addresses"`
+	PeerID           *string         `json:"peer_id"`
+	Multiaddrs       []string        `json:"multiaddrs"`
+	SectorSize       uint64          `json:"sector_size"`
+	RawPower         json.RawMessage `json:"raw_power"`
+	QaPower          json.RawMessage `json:"qa_power"`
+	HasMinPower      bool            `json:"has_min_power"`
+	Epoch            int64           `json:"epoch"`
+	RefreshedAt      time.Time       `json:"refreshed_at"`
+}
+
+var refreshProviders = &cli.Command{
+	Usage: "Record miner info and power of every known provider in its details->'chain_info'",
+	Name:  "refresh-providers",
+	Flags: []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "provider",
+			Usage: "Only refresh these providers (default: all in cargo.providers)",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+
+		ctx, closer := context.WithCancel(cctx.Context)
+		defer closer()
+
+		var refreshed, failed int
+		defer func() {
+			log.Infow("summary",
+				"refreshed", refreshed,
+				"failed", failed,
+			)
+		}()
+
+		providers, err := eligibleProviders(ctx, cctx.StringSlice("provider"), nil)
+		if err != nil {
+			return err
+		}
+
+		api, apiClose, err := lotusAPI(cctx)
+		if err != nil {
+			return xerrors.Errorf("connecting to lotus failed: %w", err)
+		}
+		defer apiClose()
+
+		lts, err := lotusLookbackTipset(cctx, api)
+		if err != nil {
+			return err
+		}
+
+		for _, sp := range providers {
+			ci, err := providerInfoFromChain(ctx, api, lts, sp)
+			if err != nil {
+				failed++
+				log.Warnf("retrieving chain info of %s failed: %s", sp, err)
+				continue
+			}
+
+			ciJSON, err := json.Marshal(ci)
+			if err != nil {
+				return err
+			}
+			if _, err := cargoDb.Exec(
+				ctx,
+				`
+				UPDATE cargo.providers SET
+					details = JSONB_SET( COALESCE( details, '{}' ), '{chain_info}', $2 )
+				WHERE provider = $1
+				`,
+				sp.String(),
+				ciJSON,
+			); err != nil {
+				return err
+			}
+			refreshed++
+		}
+
+		if failed > 0 {
+			return xerrors.Errorf("retrieving chain info failed for %d providers", failed)
+		}
+		return nil
+	},
+}
+
+func providerInfoFromChain(ctx context.Context, api *lotusapi.FullNodeStruct, lts *filtypes.TipSet, sp filaddr.Address) (*providerChainInfo, error) {
+
+	mi, err := api.StateMinerInfo(ctx, sp, lts.Key())
+	if err != nil {
+		return nil, err
+	}
+	workerKey, err := api.StateAccountKey(ctx, mi.Worker, lts.Key())
+	if err != nil {
+		return nil, err
+	}
+	pow, err := api.StateMinerPower(ctx, sp, lts.Key())
+	if err != nil {
+		return nil, err
+	}
+
+	ci := &providerChainInfo{
+		Owner:            mi.Owner.String(),
+		Worker:           mi.Worker.String(),
+		WorkerKey:        workerKey.String(),
+		ControlAddresses: make([]string, 0, len(mi.ControlAddresses)),
+		Multiaddrs:       make([]string, 0, len(mi.Multiaddrs)),
+		SectorSize:       uint64(mi.SectorSize),
+		RawPower:         json.RawMessage(pow.MinerPower.RawBytePower.String()),
+		QaPower:          json.RawMessage(pow.MinerPower.QualityAdjPower.String()),
+		HasMinPower:      pow.HasMinPower,
+		Epoch:            int64(lts.Height()),
+		RefreshedAt:      time.Now(),
+	}
+	for _, a := range mi.ControlAddresses {
+		ci.ControlAddresses = append(ci.ControlAddresses, a.String())
+	}
+	if mi.PeerId != nil {
+		p := mi.PeerId.String()
+		ci.PeerID = &p
+	}
+	for _, b := range mi.Multiaddrs {
+		// providers can put arbitrary bytes on chain: skip whatever does not decode
+		if ma, err := multiaddr.NewMultiaddrBytes(b); err == nil {
+			ci.Multiaddrs = append(ci.Multiaddrs, ma.String())
+		}
+	}
+
+	return ci, nil
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	filaddr "github.com/filecoin-project/go-address"
+	filcrypto "github.com/filecoin-project/go-state-types/crypto"
+	lotusapi "github.com/filecoin-project/lotus/api"
+	filtypes "github.com/filecoin-project/lotus/chain/types"
+	"github.com/jackc/pgx/v4"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+)
+
+const (
+	reservationHdrProvider  = "X-Cargo-Provider"
+	reservationHdrTimestamp = "X-Cargo-Timestamp"
+	reservationHdrSignature = "X-Cargo-Signature"
+	reservationMaxClockSkew = 5 * time.Minute
+)
+
+type reservableAggregate struct {
+	AggregateCid     string `json:"aggregate_cid"`
+	PieceCid         string `json:"piece_cid"`
+	PaddedPieceSize  uint64 `json:"padded_piece_size"`
+	CarURL           string `json:"car_url"`
+	DealDurationDays uint   `json:"deal_duration_days"`
+	DealDuration     int64  `json:"deal_duration_epochs"`
+	Replicas         int    `json:"current_replicas"`
+}
+
+type reservation struct {
+	ReservationID int64     `json:"reservation_id"`
+	AggregateCid  string    `json:"aggregate_cid"`
+	PieceCid      string    `json:"piece_cid"`
+	CarURL        string    `json:"car_url"`
+	ReservedUntil time.Time `json:"reserved_until"`
+}
+
+var serveReservations = &cli.Command{
+	Usage: "Serve an HTTP API allowing storage providers to reserve aggregates in need of replicas",
+	Name:  "serve-reservations",
+	Description: fmt.Sprintf(
+		"Every request must carry the headers %s (f0 address), %s (unixtime) and %s.\n"+
+			"The signature is the hex output of `lotus wallet sign <worker> <hexMessage>`,\n"+
+			"with the message being the bytes of \"<METHOD> <request-uri> <timestamp> <sha256hex of body>\".\n"+
+			"Repeating a signed POST returns the reservation the original request created.",
+		reservationHdrProvider, reservationHdrTimestamp, reservationHdrSignature,
+	),
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "listen",
+			Value: "localhost:8011",
+		},
+		&cli.UintFlag{
+			Name:  "max-in-flight-per-provider",
+			Usage: "Refuse reservations from providers with that many reservations, proposals or published deals not yet active",
+			Value: 10,
+		},
+		&cli.UintFlag{
+			Name:  "deal-duration-days",
+			Usage: "Deal duration advertised to providers",
+			Value: 520,
+		},
+		&cli.UintFlag{
+			Name:  "max-reservation-hours",
+			Usage: "Longest time window a provider can reserve an aggregate for",
+			Value: 72,
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+
+		api, apiClose, err := lotusAPI(cctx)
+		if err != nil {
+			return xerrors.Errorf("connecting to lotus failed: %w", err)
+		}
+		defer apiClose()
+
+		rs := &reservationServer{cctx: cctx, api: api}
+
+		mux := http.NewServeMux()
+		mux.Handle("/v0/aggregates", rs.authenticated(rs.listAggregates))
+		mux.Handle("/v0/reservations", rs.authenticated(rs.reservations))
+
+		srv := &http.Server{
+			Addr:         cctx.String("listen"),
+			Handler:      mux,
+			ReadTimeout:  30 * time.Second,
+			WriteTimeout: 5 * time.Minute,
+		}
+
+		go func() {
+			<-cctx.Context.Done()
+			shCtx, shCancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer shCancel()
+			srv.Shutdown(shCtx) //nolint:errcheck
+		}()
+
+		log.Infof("serving reservation API on %s", srv.Addr)
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			return err
+		}
+		return nil
+	},
+}
+
+type reservationServer struct {
+	cctx *cli.Context
+	api  *lotusapi.FullNodeStruct
+}
+
+// requestID identifies a signed request: the signature covers method, uri,
+// timestamp and body, so a replay carries the very same one
+type providerHandlerFunc func(w http.ResponseWriter, r *http.Request, provider filaddr.Address, body []byte, requestID string)
+
+func replyJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v) //nolint:errcheck
+}
+
+func replyError(w http.ResponseWriter, status int, msg string) {
+	replyJSON(w, status, map[string]string{"error": msg})
+}
+
+// authenticated verifies the request was signed by the current worker key of the claimed provider
+func (rs *reservationServer) authenticated(next providerHandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			replyError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		sp, err := filaddr.NewFromString(r.Header.Get(reservationHdrProvider))
+		if err != nil || sp.Protocol() != filaddr.ID {
+			replyError(w, http.StatusUnauthorized, "invalid or missing provider header")
+			return
+		}
+
+		ts, err := strconv.ParseInt(r.Header.Get(reservationHdrTimestamp), 10, 64)
+		if err != nil {
+			replyError(w, http.StatusUnauthorized, "invalid or missing timestamp header")
+			return
+		}
+		if skew := time.Since(time.Unix(ts, 0)); skew > reservationMaxClockSkew || skew < -reservationMaxClockSkew {
+			replyError(w, http.StatusUnauthorized, "timestamp too far from current time")
+			return
+		}
+
+		sigBytes, err := hex.DecodeString(r.Header.Get(reservationHdrSignature))
+		if err != nil {
+			replyError(w, http.StatusUnauthorized, "invalid or missing signature header")
+			return
+		}
+		var sig filcrypto.Signature
+		if err := sig.UnmarshalBinary(sigBytes); err != nil {
+			replyError(w, http.StatusUnauthorized, "undecodeable signature")
+			return
+		}
+
+		mi, err := rs.api.StateMinerInfo(r.Context(), sp, filtypes.EmptyTSK)
+		if err != nil {
+			log.Warnf("worker lookup of %s failed: %s", sp, err)
+			replyError(w, http.StatusUnauthorized, "unable to determine provider worker")
+			return
+		}
+		worker, err := rs.api.StateAccountKey(r.Context(), mi.Worker, filtypes.EmptyTSK)
+		if err != nil {
+			log.Warnf("worker key lookup of %s failed: %s", mi.Worker, err)
+			replyError(w, http.StatusUnauthorized, "unable to determine provider worker")
+			return
+		}
+
+		msg := fmt.Sprintf("%s %s %d %x", r.Method, r.URL.RequestURI(), ts, sha256.Sum256(body))
+		if ok, err := rs.api.WalletVerify(r.Context(), worker, []byte(msg), &sig); err != nil || !ok {
+			replyError(w, http.StatusUnauthorized, "signature verification failed")
+			return
+		}
+
+		next(w, r, sp, body, fmt.Sprintf("%x", sha256.Sum256(sigBytes)))
+	})
+}
+
+func (rs *reservationServer) listAggregates(w http.ResponseWriter, r *http.Request, provider filaddr.Address, _ []byte, _ string) {
+	if r.Method != http.MethodGet {
+		replyError(w, http.StatusMethodNotAllowed, "only GET supported")
+		return
+	}
+
+	head, err := rs.api.ChainHead(r.Context())
+	if err != nil {
+		log.Errorf("failed getting chain head: %s", err)
+		replyError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	candidates, _, err := replicationCandidates(r.Context(), head.Height(), int(rs.cctx.Uint("target-replicas")))
+	if err != nil {
+		log.Errorf("failed listing replication candidates: %s", err)
+		replyError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	out := make([]reservableAggregate, 0, len(candidates))
+	for _, c := range candidates {
+		if _, holds := c.holders[provider.String()]; holds {
+			continue
+		}
+		loc, err := rs.carURL(r.Context(), c.aggregateCid.String())
+		if err != nil {
+			log.Errorf("failed determining location of %s: %s", c.aggregateCid, err)
+			replyError(w, http.StatusInternalServerError, "internal error")
+			return
+		}
+		out = append(out, reservableAggregate{
+			AggregateCid:     c.aggregateCid.String(),
+			PieceCid:         c.pieceCid.String(),
+			PaddedPieceSize:  uint64(c.pieceSize),
+			CarURL:           loc,
+			DealDurationDays: rs.cctx.Uint("deal-duration-days"),
+			DealDuration:     int64(filNet.epochsIn(24 * time.Hour * time.Duration(rs.cctx.Uint("deal-duration-days")))),
+			Replicas:         c.replicas,
+		})
+	}
+
+	replyJSON(w, http.StatusOK, out)
+}
+
+func (rs *reservationServer) reservations(w http.ResponseWriter, r *http.Request, provider filaddr.Address, body []byte, requestID string) {
+	switch r.Method {
+	case http.MethodGet:
+		rs.listReservations(w, r, provider)
+	case http.MethodPost:
+		rs.reserve(w, r, provider, body, requestID)
+	default:
+		replyError(w, http.StatusMethodNotAllowed, "only GET and POST supported")
+	}
+}
+
+func (rs *reservationServer) listReservations(w http.ResponseWriter, r *http.Request, provider filaddr.Address) {
+	rows, err := cargoDb.Query(
+		r.Context(),
+		`
+		SELECT r.reservation_id, r.aggregate_cid, a.piece_cid, r.reserved_until
+			FROM cargo.reservations r
+			JOIN cargo.aggregates a USING ( aggregate_cid )
+		WHERE r.provider = $1 AND r.status = 'reserved' AND r.reserved_until > NOW()
+		ORDER BY r.reserved_until
+		`,
+		provider.String(),
+	)
+	if err != nil {
+		log.Errorf("failed listing reservations: %s", err)
+		replyError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	defer rows.Close()
+
+	out := make([]reservation, 0)
+	for rows.Next() {
+		var res reservation
+		if err := rows.Scan(&res.ReservationID, &res.AggregateCid, &res.PieceCid, &res.ReservedUntil); err != nil {
+			log.Errorf("failed listing reservations: %s", err)
+			replyError(w, http.StatusInternalServerError, "internal error")
+			return
+		}
+		if res.CarURL, err = rs.carURL(r.Context(), res.AggregateCid); err != nil {
+			log.Errorf("failed determining location of %s: %s", res.AggregateCid, err)
+			replyError(w, http.StatusInternalServerError, "internal error")
+			return
+		}
+		out = append(out, res)
+	}
+	if err := rows.Err(); err != nil {
+		log.Errorf("failed listing reservations: %s", err)
+		replyError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	replyJSON(w, http.StatusOK, out)
+}
+
+func (rs *reservationServer) reserve(w http.ResponseWriter, r *http.Request, provider filaddr.Address, body []byte, requestID string) {
+
+	var req struct {
+		PieceCid string `json:"piece_cid"`
+		Hours    uint   `json:"hours"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		replyError(w, http.StatusBadRequest, "undecodeable request body")
+		return
+	}
+	if req.Hours == 0 || req.Hours > rs.cctx.Uint("max-reservation-hours") {
+		replyError(w, http.StatusBadRequest, fmt.Sprintf("hours must be between 1 and %d", rs.cctx.Uint("max-reservation-hours")))
+		return
+	}
+
+	head, err := rs.api.ChainHead(r.Context())
+	if err != nil {
+		log.Errorf("failed getting chain head: %s", err)
+		replyError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	var res reservation
+	var refusal string
+	var replayed bool
+	// serialize all reservation attempts, so that concurrent requests do not overshoot the target
+	err = cargoDb.BeginTxFunc(r.Context(), pgx.TxOptions{}, func(tx pgx.Tx) error {
+
+		if _, err := tx.Exec(r.Context(), `LOCK TABLE cargo.reservations IN EXCLUSIVE MODE`); err != nil {
+			return err
+		}
+
+		// a request signature is good for the entire clock-skew window: answer a
+		// replay with what the original request got, instead of acting on it again
+		err := tx.QueryRow(
+			r.Context(),
+			`
+			SELECT r.reservation_id, r.aggregate_cid, a.piece_cid, r.reserved_until
+				FROM cargo.reservations r
+				JOIN cargo.aggregates a USING ( aggregate_cid )
+			WHERE r.request_id = $1
+			`,
+			requestID,
+		).Scan(&res.ReservationID, &res.AggregateCid, &res.PieceCid, &res.ReservedUntil)
+		if err == nil {
+			replayed = true
+			return nil
+		} else if err != pgx.ErrNoRows {
+			return err
+		}
+
+		candidates, providerLoad, err := replicationCandidates(r.Context(), head.Height(), int(rs.cctx.Uint("target-replicas")))
+		if err != nil {
+			return err
+		}
+		if providerLoad[provider.String()] >= int(rs.cctx.Uint("max-in-flight-per-provider")) {
+			refusal = "too many in-flight reservations, proposals or deals"
+			return nil
+		}
+
+		for _, c := range candidates {
+			if c.pieceCid.String() != req.PieceCid {
+				continue
+			}
+			if _, holds := c.holders[provider.String()]; holds {
+				refusal = "provider already holds or reserved this piece"
+				return nil
+			}
+
+			if _, err := tx.Exec(
+				r.Context(),
+				`
+				INSERT INTO cargo.providers ( provider ) VALUES ( $1 )
+					ON CONFLICT ( provider ) DO NOTHING
+				`,
+				provider.String(),
+			); err != nil {
+				return err
+			}
+
+			res.AggregateCid = c.aggregateCid.String()
+			res.PieceCid = c.pieceCid.String()
+
+			// a lapsed reservation stays 'reserved' until track-deals settles it, and
+			// would trip reservations_singleton_active
+			if _, err := tx.Exec(
+				r.Context(),
+				`
+				UPDATE cargo.reservations SET
+					status = 'expired'
+				WHERE aggregate_cid = $1 AND provider = $2 AND status = 'reserved' AND reserved_until <= NOW()
+				`,
+				res.AggregateCid,
+				provider.String(),
+			); err != nil {
+				return err
+			}
+
+			return tx.QueryRow(
+				r.Context(),
+				`
+				INSERT INTO cargo.reservations ( aggregate_cid, provider, status, reserved_until, request_id )
+					VALUES ( $1, $2, 'reserved', NOW() + $3::INTERVAL, $4 )
+				RETURNING reservation_id, reserved_until
+				`,
+				res.AggregateCid,
+				provider.String(),
+				fmt.Sprintf("%d hours", req.Hours),
+				requestID,
+			).Scan(&res.ReservationID, &res.ReservedUntil)
+		}
+
+		refusal = "piece is unknown or does not need further replicas"
+		return nil
+	})
+	if err != nil {
+		log.Errorf("reservation of %s by %s failed: %s", req.PieceCid, provider, err)
+		replyError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if refusal != "" {
+		replyError(w, http.StatusConflict, refusal)
+		return
+	}
+
+	if res.CarURL, err = rs.carURL(r.Context(), res.AggregateCid); err != nil {
+		log.Errorf("failed determining location of %s: %s", res.AggregateCid, err)
+		replyError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	if replayed {
+		log.Infow("replayed reservation request", "provider", provider, "aggregate", res.AggregateCid, "reservation", res.ReservationID)
+		replyJSON(w, http.StatusOK, res)
+		return
+	}
+
+	log.Infow("reserved", "provider", provider, "aggregate", res.AggregateCid, "until", res.ReservedUntil)
+	replyJSON(w, http.StatusCreated, res)
+}
+
+func (rs *reservationServer) carURL(ctx context.Context, aggCid string) (string, error) {
+	var pieceCid, md5hex string
+	if err := cargoDb.QueryRow(
+		ctx,
+		`SELECT piece_cid, metadata->>'md5hex' FROM cargo.aggregates WHERE aggregate_cid = $1`,
+		aggCid,
+	).Scan(&pieceCid, &md5hex); err != nil {
+		return "", err
+	}
+	return aggregateLocation(rs.cctx, aggCid, pieceCid, md5hex)
+}
+
+// settleReservations links reservations to matching deals or direct claims, and expires the ones past their window
+func settleReservations(ctx context.Context) (fulfilled, expired int64, err error) {
+	ct, err := cargoDb.Exec(
+		ctx,
+		`
+		UPDATE cargo.reservations r SET
+			status = 'fulfilled',
+			deal_id = (
+				SELECT MIN( d.deal_id )
+					FROM cargo.own_deals d
+				WHERE d.aggregate_cid = r.aggregate_cid AND d.provider = r.provider AND d.status NOT IN ( 'terminated', 'expired', 'slashed', 'invalid' )
+			),
+			allocation_id = (
+				SELECT MIN( vr.allocation_id )
+					FROM cargo.own_direct_replicas vr
+				WHERE vr.aggregate_cid = r.aggregate_cid AND vr.provider = r.provider
+			)
+		WHERE
+			r.status = 'reserved'
+				AND
+			(
+				EXISTS (
+					SELECT 42
+						FROM cargo.own_deals d
+					WHERE d.aggregate_cid = r.aggregate_cid AND d.provider = r.provider AND d.status NOT IN ( 'terminated', 'expired', 'slashed', 'invalid' )
+				)
+					OR
+				EXISTS (
+					SELECT 42
+						FROM cargo.own_direct_replicas vr
+					WHERE vr.aggregate_cid = r.aggregate_cid AND vr.provider = r.provider
+				)
+			)
+		`,
+	)
+	if err != nil {
+		return 0, 0, err
+	}
+	fulfilled = ct.RowsAffected()
+
+	ct, err = cargoDb.Exec(
+		ctx,
+		`
+		UPDATE cargo.reservations SET
+			status = 'expired'
+		WHERE status = 'reserved' AND reserved_until < NOW()
+		`,
+	)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return fulfilled, ct.RowsAffected(), nil
+}
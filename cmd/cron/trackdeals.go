@@ -1,20 +1,30 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/dustin/go-humanize"
 	filaddr "github.com/filecoin-project/go-address"
 	filabi "github.com/filecoin-project/go-state-types/abi"
+	filexitcode "github.com/filecoin-project/go-state-types/exitcode"
+	"github.com/filecoin-project/go-state-types/network"
+	lotusapi "github.com/filecoin-project/lotus/api"
+	filbuild "github.com/filecoin-project/lotus/build"
+	filmarket "github.com/filecoin-project/lotus/chain/actors/builtin/market"
 	filprovider "github.com/filecoin-project/lotus/chain/actors/builtin/miner"
+	filtypes "github.com/filecoin-project/lotus/chain/types"
 	"github.com/ipfs/go-cid"
 	"github.com/urfave/cli/v2"
 	"golang.org/x/xerrors"
 )
 
+const dealTrackerStateKey = "track-deals"
+
 type filClient struct {
 	robust           filaddr.Address
 	dataCapRemaining *filabi.StoragePower
@@ -23,24 +33,127 @@ type filDeal struct {
 	pieceCid     cid.Cid
 	aggregateCid cid.Cid
 	status       string
+	endEpoch     filabi.ChainEpoch
+}
+
+// deals in these states are not going to change again, bar invalid ones re-checked by a full scan
+func isFinalDealStatus(status string) bool {
+	return status == "terminated" || status == "expired" || status == "slashed" || status == "invalid"
+}
+
+// the PublishStorageDeals message that created a deal, and the epoch it was executed at
+type dealPublication struct {
+	msgCid cid.Cid
+	epoch  filabi.ChainEpoch
+}
+
+// persisted in cargo.runtime_state between runs
+type dealTrackerState struct {
+	LastTipsetHeight filabi.ChainEpoch `json:"last_tipset_height"`
+	LastTipsetKey    []cid.Cid         `json:"last_tipset_key"`
+	LastFullScan     time.Time         `json:"last_full_scan"`
+	LastVerifRegScan time.Time         `json:"last_verifreg_scan"`
+}
+
+// dealTrackingRun holds everything accumulated during a single track-deals invocation
+type dealTrackingRun struct {
+	api          *lotusapi.FullNodeStruct
+	verifreg     *verifRegAPI
+	events       *actorEventsAPI
+	lts          *filtypes.TipSet
+	aggCidLookup map[cid.Cid]cid.Cid
+	pieceSizes   map[cid.Cid]filabi.PaddedPieceSize
+	knownDeals   map[int64]filDeal
+	publications map[int64]dealPublication // only deals discovered by walking the chain or from market events
+	clientLookup map[filaddr.Address]filClient
+	ownClients   map[filaddr.Address]struct{} // robust addresses, empty means every client counts as own
+
+	expiringHorizon filabi.ChainEpoch
+	allowUnverified bool
+	minDuration     filabi.ChainEpoch
+	maxDuration     filabi.ChainEpoch
+
+	dealTotals          map[string]int64
+	dealOrigins         map[string]int64
+	newDealCount        int
+	terminatedDealCount int
+	expiredDealCount    int
+	slashedDealCount    int
+	invalidDealCount    int
 }
 
 var trackDeals = &cli.Command{
 	Usage: "Track state of filecoin deals related to known PieceCIDs",
 	Name:  "track-deals",
-	Flags: []cli.Flag{},
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "full-scan",
+			Usage: "Retrieve the entire StateMarketDeals list instead of tracking changes since the previous run",
+		},
+		&cli.UintFlag{
+			Name:  "full-scan-interval-hours",
+			Usage: "Perform a full StateMarketDeals scan when the last one is older than this",
+			Value: 24,
+		},
+		&cli.UintFlag{
+			Name:  "verifreg-scan-interval-hours",
+			Usage: "Refresh verified registry allocations and claims, which takes a call per provider, when the last refresh is older than this",
+			Value: 6,
+		},
+		&cli.UintFlag{
+			Name:  "max-incremental-epochs",
+			Usage: "Perform a full scan instead of walking the chain when the previous run is further behind than this",
+			Value: 2 * 60 * 24, // 1 day worth of 30s epochs
+		},
+		&cli.BoolFlag{
+			Name:  "check-sectors",
+			Usage: "Check the sectors containing active deals for faults and early termination",
+		},
+		&cli.UintFlag{
+			Name:  "expiring-horizon-days",
+			Usage: "Mark active deals as expiring when their end epoch is this close",
+			Value: 30,
+		},
+		&cli.BoolFlag{
+			Name:  "allow-unverified",
+			Usage: "Do not mark newly discovered deals made without DataCap as invalid",
+		},
+		&cli.UintFlag{
+			Name:  "min-deal-duration-days",
+			Usage: "Mark newly discovered deals shorter than this as invalid",
+			Value: 180,
+		},
+		&cli.UintFlag{
+			Name:  "max-deal-duration-days",
+			Usage: "Mark newly discovered deals longer than this as invalid",
+			Value: 540,
+		},
+		&cli.UintFlag{
+			Name:  "finality-epochs",
+			Usage: "Consider recorded deal events final once they are this many epochs behind the lookback tipset",
+			Value: uint(filbuild.Finality),
+		},
+	},
 	Action: func(cctx *cli.Context) error {
 
 		ctx, closer := context.WithCancel(cctx.Context)
 		defer closer()
 
-		clientLookup := make(map[filaddr.Address]filClient, 32)
-		knownDeals := make(map[int64]filDeal)
-		aggCidLookup := make(map[cid.Cid]cid.Cid)
+		run := &dealTrackingRun{
+			aggCidLookup: make(map[cid.Cid]cid.Cid),
+			pieceSizes:   make(map[cid.Cid]filabi.PaddedPieceSize),
+			knownDeals:   make(map[int64]filDeal),
+			publications: make(map[int64]dealPublication),
+			clientLookup: make(map[filaddr.Address]filClient, 32),
+			dealTotals:   make(map[string]int64),
+			dealOrigins:  make(map[string]int64),
+			ownClients:   make(map[filaddr.Address]struct{}),
+		}
+
 		rows, err := cargoDb.Query(
 			ctx,
 			`
-			SELECT a.aggregate_cid, a.piece_cid, d.deal_id, d.status
+			SELECT a.aggregate_cid, a.piece_cid, a.piece_size, d.deal_id, d.status, d.end_epoch
 				FROM cargo.aggregates a
 				LEFT JOIN cargo.deals d USING ( aggregate_cid )
 			`,
@@ -51,10 +164,12 @@ var trackDeals = &cli.Command{
 		for rows.Next() {
 			var aCidStr string
 			var pCidStr string
+			var pieceSize filabi.PaddedPieceSize
 			var dealID *int64
 			var dealStatus *string
+			var dealEnd *filabi.ChainEpoch
 
-			if err = rows.Scan(&aCidStr, &pCidStr, &dealID, &dealStatus); err != nil {
+			if err = rows.Scan(&aCidStr, &pCidStr, &pieceSize, &dealID, &dealStatus, &dealEnd); err != nil {
 				return err
 			}
 			aCid, err := cid.Parse(aCidStr)
@@ -67,205 +182,761 @@ var trackDeals = &cli.Command{
 			}
 
 			if dealID != nil {
-				knownDeals[*dealID] = filDeal{
+				run.knownDeals[*dealID] = filDeal{
 					pieceCid:     pCid,
 					aggregateCid: aCid,
 					status:       *dealStatus,
+					endEpoch:     *dealEnd,
 				}
 			}
-			aggCidLookup[pCid] = aCid
+			run.aggCidLookup[pCid] = aCid
+			run.pieceSizes[pCid] = pieceSize
 		}
 		if err := rows.Err(); err != nil {
 			return err
 		}
 
-		var newDealCount, terminatedDealCount int
-		dealTotals := make(map[string]int64)
+		scanMode := "none"
+		var sectorStates map[string]int
+		var ownClientDataCap map[string]string
+		var verifiedReplicas map[string]int64
+		var reservationsFulfilled, reservationsExpired, scorecardsUpdated int64
+		var eventsFinalized, eventsReverted int
 		defer func() {
 			log.Infow("summary",
-				"knownPieces", len(aggCidLookup),
-				"relatedDeals", dealTotals,
-				"newlyAdded", newDealCount,
-				"newlyTerminated", terminatedDealCount,
+				"scanMode", scanMode,
+				"reservationsFulfilled", reservationsFulfilled,
+				"reservationsExpired", reservationsExpired,
+				"knownPieces", len(run.aggCidLookup),
+				"relatedDeals", run.dealTotals,
+				"relatedDealOrigins", run.dealOrigins,
+				"newlyAdded", run.newDealCount,
+				"newlyTerminated", run.terminatedDealCount,
+				"newlyExpired", run.expiredDealCount,
+				"newlySlashed", run.slashedDealCount,
+				"newlyInvalid", run.invalidDealCount,
+				"sectorStates", sectorStates,
+				"verifiedReplicas", verifiedReplicas,
+				"eventsFinalized", eventsFinalized,
+				"eventsReverted", eventsReverted,
+				"providerScorecardsUpdated", scorecardsUpdated,
+				"ownClientDataCap", ownClientDataCap,
 			)
 		}()
 
-		if len(aggCidLookup) == 0 {
+		clients, err := ownClients(cctx)
+		if err != nil {
+			return err
+		}
+
+		if len(run.aggCidLookup) == 0 && len(clients) == 0 {
 			return nil
 		}
 
-		log.Infof("checking the status of %s known Piece CIDs", humanize.Comma(int64(len(aggCidLookup))))
+		log.Infof("checking the status of %s known Piece CIDs", humanize.Comma(int64(len(run.aggCidLookup))))
 
-		api, apiClose, err := lotusAPI(cctx)
+		api, verifreg, events, apiClose, err := lotusAPIWithExtensions(cctx)
 		if err != nil {
 			return xerrors.Errorf("connecting to lotus failed: %w", err)
 		}
 		defer apiClose()
+		run.api = api
+		run.verifreg = verifreg
+		run.events = events
+		run.expiringHorizon = filNet.epochsIn(24 * time.Hour * time.Duration(cctx.Uint("expiring-horizon-days")))
+		run.allowUnverified = cctx.Bool("allow-unverified")
+		run.minDuration = filNet.epochsIn(24 * time.Hour * time.Duration(cctx.Uint("min-deal-duration-days")))
+		run.maxDuration = filNet.epochsIn(24 * time.Hour * time.Duration(cctx.Uint("max-deal-duration-days")))
 
-		lts, err := lotusLookbackTipset(cctx, api)
+		run.lts, err = lotusLookbackTipset(cctx, api)
 		if err != nil {
 			return err
 		}
 
-		log.Infow("retrieving Market Deals from", "state", lts.Key(), "epoch", lts.Height(), "wallTime", time.Unix(int64(lts.Blocks()[0].Timestamp), 0))
-		deals, err := api.StateMarketDeals(ctx, lts.Key())
+		if ownClientDataCap, err = run.recordOwnClients(ctx, clients); err != nil {
+			return err
+		}
+
+		var state dealTrackerState
+		haveState, err := loadRuntimeState(ctx, dealTrackerStateKey, &state)
 		if err != nil {
 			return err
 		}
-		log.Infof("retrieved %s state deal records", humanize.Comma(int64(len(deals))))
 
-		for dealIDString, d := range deals {
-			aggCid, known := aggCidLookup[d.Proposal.PieceCID]
-			if !known {
-				continue
+		switch {
+		case cctx.Bool("full-scan"):
+			scanMode = "full (requested)"
+		case !haveState:
+			scanMode = "full (no prior state)"
+		case time.Since(state.LastFullScan) > time.Hour*time.Duration(cctx.Uint("full-scan-interval-hours")):
+			scanMode = "full (scheduled)"
+		case run.lts.Height() < state.LastTipsetHeight:
+			scanMode = "full (lotus behind previous run)"
+		case run.lts.Height()-state.LastTipsetHeight > filabi.ChainEpoch(cctx.Uint("max-incremental-epochs")):
+			scanMode = "full (previous run too far behind)"
+		default:
+			scanMode = "incremental"
+			if err := run.incrementalScan(ctx, state); err != nil {
+				if !xerrors.Is(err, errDealTrackerReorg) {
+					return err
+				}
+				log.Warnf("%s, falling back to full scan", err)
+				scanMode = "full (reorg past previous run)"
 			}
+		}
 
-			dealID, err := strconv.ParseInt(dealIDString, 10, 64)
-			if err != nil {
+		if strings.HasPrefix(scanMode, "full") {
+			if err := run.fullScan(ctx); err != nil {
 				return err
 			}
+			state.LastFullScan = time.Now()
+		}
 
-			var initialEncounter bool
-			if _, known := knownDeals[dealID]; !known {
-				initialEncounter = true
-			} else {
-				// at the end whatever remains is not in SMA list, thus will be marked "terminated"
-				delete(knownDeals, dealID)
+		if cctx.Bool("full-scan") || time.Since(state.LastVerifRegScan) > time.Hour*time.Duration(cctx.Uint("verifreg-scan-interval-hours")) {
+			if verifiedReplicas, err = run.trackVerifiedReplicas(ctx); err != nil {
+				return err
 			}
+			state.LastVerifRegScan = time.Now()
+		}
 
-			_, err = cargoDb.Exec(
-				ctx,
-				`
-				INSERT INTO cargo.providers ( provider ) VALUES ( $1 )
-					ON CONFLICT ( provider ) DO NOTHING
-				`,
-				d.Proposal.Provider.String(),
-			)
-			if err != nil {
+		if cctx.Bool("check-sectors") {
+			if sectorStates, err = run.checkSectors(ctx); err != nil {
 				return err
 			}
+		}
 
-			if _, found := clientLookup[d.Proposal.Client]; !found {
-				var fc filClient
+		if eventsFinalized, eventsReverted, err = run.settleDealEvents(ctx, filabi.ChainEpoch(cctx.Uint("finality-epochs"))); err != nil {
+			return err
+		}
 
-				fc.robust, err = api.StateAccountKey(ctx, d.Proposal.Client, lts.Key())
-				if err != nil {
-					return err
-				}
+		if reservationsFulfilled, reservationsExpired, err = settleReservations(ctx); err != nil {
+			return err
+		}
 
-				fc.dataCapRemaining, err = api.StateVerifiedClientStatus(ctx, fc.robust, lts.Key())
-				if err != nil {
-					return err
-				}
-				if fc.dataCapRemaining == nil {
-					z := filabi.NewStoragePower(0)
-					fc.dataCapRemaining = &z
-				}
+		if scorecardsUpdated, err = updateProviderScorecards(ctx); err != nil {
+			return err
+		}
 
-				_, err = cargoDb.Exec(
-					ctx,
-					`
-					INSERT INTO cargo.clients ( client, filp_available ) VALUES ( $1, $2 )
-						ON CONFLICT ( client ) DO UPDATE SET
-							filp_available = EXCLUDED.filp_available
-					`,
-					fc.robust.String(),
-					fc.dataCapRemaining.Int64(),
-				)
-				if err != nil {
-					return err
-				}
+		state.LastTipsetHeight = run.lts.Height()
+		state.LastTipsetKey = run.lts.Cids()
+		return saveRuntimeState(ctx, dealTrackerStateKey, state)
+	},
+}
+
+var errDealTrackerReorg = xerrors.New("tipset recorded by previous run is no longer part of the chain")
+
+// fullScan pulls the entire market actor state, and terminates every known deal not present in it
+func (run *dealTrackingRun) fullScan(ctx context.Context) error {
+
+	log.Infow("retrieving Market Deals from", "state", run.lts.Key(), "epoch", run.lts.Height(), "wallTime", time.Unix(int64(run.lts.Blocks()[0].Timestamp), 0))
+	deals, err := run.api.StateMarketDeals(ctx, run.lts.Key())
+	if err != nil {
+		return err
+	}
+	log.Infof("retrieved %s state deal records", humanize.Comma(int64(len(deals))))
+
+	seen := make(map[int64]struct{}, len(run.knownDeals))
+	for dealIDString, d := range deals {
+		if _, known := run.aggCidLookup[d.Proposal.PieceCID]; !known {
+			continue
+		}
+
+		dealID, err := strconv.ParseInt(dealIDString, 10, 64)
+		if err != nil {
+			return err
+		}
+		seen[dealID] = struct{}{}
+
+		if err := run.recordDeal(ctx, dealID, d); err != nil {
+			return err
+		}
+	}
+
+	// whatever remains is not in SMA list, thus will be marked "terminated" or "expired"
+	gone := make([]int64, 0, len(run.knownDeals))
+	for dID := range run.knownDeals {
+		if _, found := seen[dID]; !found {
+			gone = append(gone, dID)
+		}
+	}
+	return run.retireDeals(ctx, gone)
+}
+
+// incrementalScan discovers new deals from PublishStorageDeals messages executed
+// since the previously processed tipset, and refreshes only deals we already know
+func (run *dealTrackingRun) incrementalScan(ctx context.Context, state dealTrackerState) error {
+
+	log.Infow("scanning chain for newly published deals",
+		"fromEpoch", state.LastTipsetHeight,
+		"toEpoch", run.lts.Height(),
+		"wallTime", time.Unix(int64(run.lts.Blocks()[0].Timestamp), 0),
+	)
+
+	// walk back from the lookback tipset, processing messages executed by each
+	// tipset's parent state, until we reach what the previous run already covered
+	toRefresh := make(map[int64]struct{}, len(run.knownDeals))
+	executedAt := make(map[filtypes.TipSetKey]filabi.ChainEpoch)
+	ts := run.lts
+	for ts.Height() > state.LastTipsetHeight {
+		newIDs, err := run.publishedDealIDs(ctx, ts)
+		if err != nil {
+			return err
+		}
+		for _, id := range newIDs {
+			toRefresh[id] = struct{}{}
+		}
+		executedAt[ts.Parents()] = ts.Height()
+
+		if ts, err = run.api.ChainGetTipSet(ctx, ts.Parents()); err != nil {
+			return err
+		}
+	}
+	if ts.Height() != state.LastTipsetHeight || ts.Key() != filtypes.NewTipSetKey(state.LastTipsetKey...) {
+		return xerrors.Errorf("%w: expected %s at epoch %d", errDealTrackerReorg, filtypes.NewTipSetKey(state.LastTipsetKey...), state.LastTipsetHeight)
+	}
+	walked := len(toRefresh)
 
-				clientLookup[d.Proposal.Client] = fc
+	// events additionally cover publications not sent to the market actor directly
+	evIDs, err := run.publishedDealIDsFromEvents(ctx, state.LastTipsetHeight, run.lts.Height()-1, executedAt)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// older nodes, or nodes without event indexing, still leave us the message walk
+		log.Warnf("retrieving market deal events failed, relying on PublishStorageDeals messages only: %s", err)
+	}
+	for _, id := range evIDs {
+		toRefresh[id] = struct{}{}
+	}
+	log.Infof("found %d new deals for known pieces, %d more from market events", walked, len(toRefresh)-walked)
+
+	for dID, d := range run.knownDeals {
+		if !isFinalDealStatus(d.status) {
+			toRefresh[dID] = struct{}{}
+		} else {
+			run.dealTotals[d.status]++
+		}
+	}
+
+	gone := make([]int64, 0)
+	for dealID := range toRefresh {
+		d, err := run.api.StateMarketStorageDeal(ctx, filabi.DealID(dealID), run.lts.Key())
+		if err != nil {
+			if isDealNotFound(err, dealID) {
+				if _, known := run.knownDeals[dealID]; known {
+					gone = append(gone, dealID)
+				}
+				continue
 			}
+			return xerrors.Errorf("refreshing state of deal %d failed: %w", dealID, err)
+		}
+
+		// a proposal for someone else's piece that was bundled with ours
+		if _, known := run.aggCidLookup[d.Proposal.PieceCID]; !known {
+			continue
+		}
+
+		if err := run.recordDeal(ctx, dealID, *d); err != nil {
+			return err
+		}
+	}
+
+	return run.retireDeals(ctx, gone)
+}
+
+// publishedDealIDs returns the deal IDs created by successful PublishStorageDeals
+// messages executed as part of ts's parent state, limited to proposals for known pieces
+func (run *dealTrackingRun) publishedDealIDs(ctx context.Context, ts *filtypes.TipSet) ([]int64, error) {
+	blk := ts.Blocks()[0].Cid()
+
+	msgs, err := run.api.ChainGetParentMessages(ctx, blk)
+	if err != nil {
+		return nil, err
+	}
+	receipts, err := run.api.ChainGetParentReceipts(ctx, blk)
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) != len(receipts) {
+		return nil, xerrors.Errorf("mismatched amount of messages (%d) and receipts (%d) for parents of tipset at epoch %d", len(msgs), len(receipts), ts.Height())
+	}
 
-			var statusMeta *string
-			var sectorStart *filabi.ChainEpoch
-			status := "published"
-			if d.State.SectorStartEpoch > 0 {
-				sectorStart = &d.State.SectorStartEpoch
-				status = "active"
-				m := fmt.Sprintf(
-					"containing sector active as of %s at epoch %d",
-					mainnetTime(d.State.SectorStartEpoch).Format("2006-01-02 15:04:05"),
-					d.State.SectorStartEpoch,
-				)
-				statusMeta = &m
-			} else if d.Proposal.StartEpoch+filprovider.WPoStChallengeWindow < lts.Height() {
-				// if things are lookback+one deadlines late: they are never going to make it
-				status = "terminated"
-				m := fmt.Sprintf(
-					"containing sector missed expected sealing epoch %d",
-					d.Proposal.StartEpoch,
-				)
-				statusMeta = &m
+	var ids []int64
+	var nv *network.Version
+	for i, m := range msgs {
+		if m.Message.To != filmarket.Address ||
+			m.Message.Method != filmarket.Methods.PublishStorageDeals ||
+			receipts[i].ExitCode != filexitcode.Ok {
+			continue
+		}
+
+		var params filmarket.PublishStorageDealsParams
+		if err := params.UnmarshalCBOR(bytes.NewReader(m.Message.Params)); err != nil {
+			return nil, xerrors.Errorf("decoding params of message %s failed: %w", m.Cid, err)
+		}
+
+		var ours []int
+		for j := range params.Deals {
+			if _, known := run.aggCidLookup[params.Deals[j].Proposal.PieceCID]; known {
+				ours = append(ours, j)
 			}
+		}
+		if len(ours) == 0 {
+			continue
+		}
 
-			dealTotals[status]++
-			if initialEncounter {
-				if status == "terminated" {
-					terminatedDealCount++
-				} else {
-					newDealCount++
-				}
+		// the messages were executed on top of the parent tipset
+		if nv == nil {
+			v, err := run.api.StateNetworkVersion(ctx, ts.Parents())
+			if err != nil {
+				return nil, err
+			}
+			nv = &v
+		}
+		ret, err := decodePublishStorageDealsReturn(receipts[i].Return, *nv)
+		if err != nil {
+			return nil, xerrors.Errorf("decoding return of message %s failed: %w", m.Cid, err)
+		}
+		published, err := ret.dealIDsByProposal(len(params.Deals))
+		if err != nil {
+			return nil, xerrors.Errorf("message %s: %w", m.Cid, err)
+		}
+		for _, j := range ours {
+			// proposals failing validation are dropped from the batch since network version 14
+			id, valid := published[j]
+			if !valid {
+				continue
 			}
+			ids = append(ids, int64(id))
+			run.publications[int64(id)] = dealPublication{msgCid: m.Cid, epoch: ts.Height()}
+		}
+	}
 
-			_, err = cargoDb.Exec(
-				ctx,
-				`
-				INSERT INTO cargo.deals ( aggregate_cid, client, provider, deal_id, start_epoch, end_epoch, status, status_meta, sector_start_epoch )
-					VALUES ( $1, $2, $3, $4, $5, $6, $7, $8, $9 )
-				ON CONFLICT ( deal_id ) DO UPDATE SET
-					status = EXCLUDED.status,
-					status_meta = EXCLUDED.status_meta,
-					sector_start_epoch = COALESCE( EXCLUDED.sector_start_epoch, cargo.deals.sector_start_epoch )
-				`,
-				aggCid.String(),
-				clientLookup[d.Proposal.Client].robust.String(),
-				d.Proposal.Provider.String(),
-				dealID,
-				d.Proposal.StartEpoch,
+	return ids, nil
+}
+
+func (run *dealTrackingRun) recordDeal(ctx context.Context, dealID int64, d lotusapi.MarketDeal) error {
+	aggCid := run.aggCidLookup[d.Proposal.PieceCID]
+	lts := run.lts
+
+	_, initialEncounter := run.knownDeals[dealID]
+	initialEncounter = !initialEncounter
+
+	_, err := cargoDb.Exec(
+		ctx,
+		`
+		INSERT INTO cargo.providers ( provider ) VALUES ( $1 )
+			ON CONFLICT ( provider ) DO NOTHING
+		`,
+		d.Proposal.Provider.String(),
+	)
+	if err != nil {
+		return err
+	}
+
+	fc, err := run.lookupClient(ctx, d.Proposal.Client)
+	if err != nil {
+		return err
+	}
+
+	var sectorStart, slashEpoch *filabi.ChainEpoch
+	if d.State.SectorStartEpoch > 0 {
+		sectorStart = &d.State.SectorStartEpoch
+	}
+	if d.State.SlashEpoch > -1 {
+		slashEpoch = &d.State.SlashEpoch
+	}
+	// deals recorded as valid are never downgraded: only new ones, and ones
+	// already invalid ( re-checked on --full-scan ), are held to the proposal checks
+	status, statusMeta := run.dealStatusAt(aggCid, d, lts.Height(), initialEncounter || run.knownDeals[dealID].status == "invalid")
+
+	run.dealTotals[status]++
+	if _, own := run.ownClients[fc.robust]; own || len(run.ownClients) == 0 {
+		run.dealOrigins["own"]++
+	} else {
+		run.dealOrigins["foreign"]++
+	}
+	if initialEncounter {
+		if status == "invalid" {
+			run.invalidDealCount++
+		} else if isFinalDealStatus(status) {
+			run.terminatedDealCount++
+		} else {
+			run.newDealCount++
+		}
+	} else if status == "expired" && run.knownDeals[dealID].status != "expired" {
+		run.expiredDealCount++
+	} else if status == "slashed" && run.knownDeals[dealID].status != "slashed" {
+		run.slashedDealCount++
+	}
+
+	var pubMsg *string
+	var pubEpoch *filabi.ChainEpoch
+	if pub, found := run.publications[dealID]; found {
+		c := pub.msgCid.String()
+		pubMsg, pubEpoch = &c, &pub.epoch
+	}
+
+	// the observed tipset only moves along with a status change, so that it
+	// reflects when the current status was first seen
+	_, err = cargoDb.Exec(
+		ctx,
+		`
+		INSERT INTO cargo.deals ( aggregate_cid, client, provider, deal_id, start_epoch, end_epoch, status, status_meta, sector_start_epoch, slash_epoch, publish_message_cid, publish_epoch, status_observed_epoch, status_observed_tipset_key, verified, label, price_per_epoch, provider_collateral, client_collateral )
+			VALUES ( $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19 )
+		ON CONFLICT ( deal_id ) DO UPDATE SET
+			status = EXCLUDED.status,
+			status_meta = EXCLUDED.status_meta,
+			sector_start_epoch = COALESCE( EXCLUDED.sector_start_epoch, cargo.deals.sector_start_epoch ),
+			slash_epoch = COALESCE( EXCLUDED.slash_epoch, cargo.deals.slash_epoch ),
+			publish_message_cid = COALESCE( cargo.deals.publish_message_cid, EXCLUDED.publish_message_cid ),
+			publish_epoch = COALESCE( cargo.deals.publish_epoch, EXCLUDED.publish_epoch ),
+			verified = COALESCE( cargo.deals.verified, EXCLUDED.verified ),
+			label = COALESCE( cargo.deals.label, EXCLUDED.label ),
+			price_per_epoch = COALESCE( cargo.deals.price_per_epoch, EXCLUDED.price_per_epoch ),
+			provider_collateral = COALESCE( cargo.deals.provider_collateral, EXCLUDED.provider_collateral ),
+			client_collateral = COALESCE( cargo.deals.client_collateral, EXCLUDED.client_collateral ),
+			status_observed_epoch = CASE WHEN cargo.deals.status IS DISTINCT FROM EXCLUDED.status THEN EXCLUDED.status_observed_epoch ELSE cargo.deals.status_observed_epoch END,
+			status_observed_tipset_key = CASE WHEN cargo.deals.status IS DISTINCT FROM EXCLUDED.status THEN EXCLUDED.status_observed_tipset_key ELSE cargo.deals.status_observed_tipset_key END
+		`,
+		aggCid.String(),
+		fc.robust.String(),
+		d.Proposal.Provider.String(),
+		dealID,
+		d.Proposal.StartEpoch,
+		d.Proposal.EndEpoch,
+		status,
+		statusMeta,
+		sectorStart,
+		slashEpoch,
+		pubMsg,
+		pubEpoch,
+		lts.Height(),
+		tipsetKeyStrings(lts),
+		d.Proposal.VerifiedDeal,
+		// labels are arbitrary client-supplied bytes, TEXT can not hold NULs
+		strings.ReplaceAll(strings.ToValidUTF8(d.Proposal.Label, "\uFFFD"), "\x00", "\uFFFD"),
+		d.Proposal.StoragePricePerEpoch.String(),
+		d.Proposal.ProviderCollateral.String(),
+		d.Proposal.ClientCollateral.String(),
+	)
+	return err
+}
+
+// lookupClient resolves a client address to its robust form, recording it in
+// cargo.clients along with its remaining DataCap on first encounter
+func (run *dealTrackingRun) lookupClient(ctx context.Context, client filaddr.Address) (filClient, error) {
+	if fc, found := run.clientLookup[client]; found {
+		return fc, nil
+	}
+
+	var fc filClient
+	var err error
+
+	fc.robust, err = run.api.StateAccountKey(ctx, client, run.lts.Key())
+	if err != nil {
+		return fc, err
+	}
+
+	fc.dataCapRemaining, err = run.api.StateVerifiedClientStatus(ctx, fc.robust, run.lts.Key())
+	if err != nil {
+		return fc, err
+	}
+	if fc.dataCapRemaining == nil {
+		z := filabi.NewStoragePower(0)
+		fc.dataCapRemaining = &z
+	}
+
+	_, err = cargoDb.Exec(
+		ctx,
+		`
+		INSERT INTO cargo.clients ( client, filp_available ) VALUES ( $1, $2 )
+			ON CONFLICT ( client ) DO UPDATE SET
+				filp_available = EXCLUDED.filp_available
+		`,
+		fc.robust.String(),
+		fc.dataCapRemaining.String(),
+	)
+	if err != nil {
+		return fc, err
+	}
+
+	run.clientLookup[client] = fc
+	return fc, nil
+}
+
+func tipsetKeyStrings(ts *filtypes.TipSet) []string {
+	cids := ts.Cids()
+	strs := make([]string, len(cids))
+	for i := range cids {
+		strs[i] = cids[i].String()
+	}
+	return strs
+}
+
+// dealStatusAt derives our status of a deal from its market state as of height,
+// marking it invalid on a proposal mismatch when checkProposal is set
+func (run *dealTrackingRun) dealStatusAt(aggCid cid.Cid, d lotusapi.MarketDeal, height filabi.ChainEpoch, checkProposal bool) (string, *string) {
+	var statusMeta *string
+	status := "published"
+	if d.State.SlashEpoch > -1 {
+		status = "slashed"
+		m := fmt.Sprintf(
+			"deal slashed as of %s at epoch %d",
+			filNet.epochTime(d.State.SlashEpoch).Format("2006-01-02 15:04:05"),
+			d.State.SlashEpoch,
+		)
+		statusMeta = &m
+	} else if d.State.SectorStartEpoch > 0 {
+		status = "active"
+		m := fmt.Sprintf(
+			"containing sector active as of %s at epoch %d",
+			filNet.epochTime(d.State.SectorStartEpoch).Format("2006-01-02 15:04:05"),
+			d.State.SectorStartEpoch,
+		)
+		statusMeta = &m
+		if d.Proposal.EndEpoch <= height {
+			status = "expired"
+			m := fmt.Sprintf(
+				"deal ended as of %s at epoch %d",
+				filNet.epochTime(d.Proposal.EndEpoch).Format("2006-01-02 15:04:05"),
 				d.Proposal.EndEpoch,
-				status,
-				statusMeta,
-				sectorStart,
 			)
+			statusMeta = &m
+		} else if d.Proposal.EndEpoch-height <= run.expiringHorizon {
+			status = "expiring"
+			m := fmt.Sprintf(
+				"deal ends at %s at epoch %d",
+				filNet.epochTime(d.Proposal.EndEpoch).Format("2006-01-02 15:04:05"),
+				d.Proposal.EndEpoch,
+			)
+			statusMeta = &m
+		}
+	} else if d.Proposal.StartEpoch+filprovider.WPoStChallengeWindow < height {
+		// if things are lookback+one deadlines late: they are never going to make it
+		status = "terminated"
+		m := fmt.Sprintf(
+			"containing sector missed expected sealing epoch %d",
+			d.Proposal.StartEpoch,
+		)
+		statusMeta = &m
+	}
+
+	if !checkProposal {
+		return status, statusMeta
+	}
+	if reason := run.dealMismatch(aggCid, d.Proposal); reason != "" {
+		status = "invalid"
+		statusMeta = &reason
+	}
+
+	return status, statusMeta
+}
+
+// dealMismatch returns why a proposal matching one of our PieceCIDs is not a
+// deal for the aggregate as we recorded it, or an empty string if it is
+func (run *dealTrackingRun) dealMismatch(aggCid cid.Cid, p filmarket.DealProposal) string {
+	if expected := run.pieceSizes[p.PieceCID]; p.PieceSize != expected {
+		return fmt.Sprintf("proposal piece size %d does not match aggregate piece size %d", p.PieceSize, expected)
+	}
+	if labelCid, err := cid.Decode(p.Label); err != nil || !cidv1(labelCid).Equals(aggCid) {
+		return fmt.Sprintf("proposal label '%s' does not reference aggregate %s", p.Label, aggCid)
+	}
+	if !p.VerifiedDeal && !run.allowUnverified {
+		return "proposal is not a verified deal"
+	}
+	if dur := p.EndEpoch - p.StartEpoch; dur < run.minDuration || dur > run.maxDuration {
+		return fmt.Sprintf("proposal duration of %d epochs is outside of the expected %d-%d", dur, run.minDuration, run.maxDuration)
+	}
+	return ""
+}
+
+// retireDeals marks deals that are no longer part of the market actor state:
+// ones past their end epoch as "expired", everything else as "terminated"
+func (run *dealTrackingRun) retireDeals(ctx context.Context, dealIDs []int64) error {
+	toFail := make([]int64, 0, len(dealIDs))
+	for _, dID := range dealIDs {
+		d := run.knownDeals[dID]
+
+		status := "terminated"
+		if d.endEpoch <= run.lts.Height() {
+			status = "expired"
+		}
+		run.dealTotals[status]++
+
+		if isFinalDealStatus(d.status) {
+			continue
+		}
+		if status == "expired" {
+			run.expiredDealCount++
+		} else {
+			run.terminatedDealCount++
+		}
+		toFail = append(toFail, dID)
+	}
+	if len(toFail) == 0 {
+		return nil
+	}
+
+	_, err := cargoDb.Exec(
+		ctx,
+		`
+		UPDATE cargo.deals SET
+			status = CASE WHEN end_epoch <= $1 THEN 'expired' ELSE 'terminated' END,
+			status_meta = 'deal no longer part of market-actor state',
+			status_observed_epoch = $1,
+			status_observed_tipset_key = $3
+		WHERE
+			deal_id = ANY ( $2::BIGINT[] )
+				AND
+			status NOT IN ( 'terminated', 'expired', 'slashed', 'invalid' )
+		`,
+		run.lts.Height(),
+		toFail,
+		tipsetKeyStrings(run.lts),
+	)
+	return err
+}
+
+// checkSectors locates the sectors holding our active deals, recording their
+// number, expiration and whether they are currently faulty or already gone
+func (run *dealTrackingRun) checkSectors(ctx context.Context) (map[string]int, error) {
+
+	type sectorDeal struct {
+		dealID int64
+		sector *filabi.SectorNumber
+	}
+	perProvider := make(map[filaddr.Address][]*sectorDeal)
+
+	rows, err := cargoDb.Query(
+		ctx,
+		`
+		SELECT deal_id, provider, sector_number
+			FROM cargo.deals
+		WHERE status IN ( 'active', 'expiring' )
+		`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		sd := new(sectorDeal)
+		var spStr string
+		if err := rows.Scan(&sd.dealID, &spStr, &sd.sector); err != nil {
+			return nil, err
+		}
+		sp, err := filaddr.NewFromString(spStr)
+		if err != nil {
+			return nil, err
+		}
+		perProvider[sp] = append(perProvider[sp], sd)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	sectorStates := make(map[string]int)
+	for sp, deals := range perProvider {
+
+		faults, err := run.api.StateMinerFaults(ctx, sp, run.lts.Key())
+		if err != nil {
+			return nil, xerrors.Errorf("retrieving faults of %s failed: %w", sp, err)
+		}
+
+		// the deal => sector mapping is not kept by the market actor: sift through
+		// every live sector of a provider only when there is something new. The
+		// active set leaves out faulty and not yet proven sectors, whose deals
+		// would then stay unlocated.
+		var unlocated map[int64]*sectorDeal
+		for _, sd := range deals {
+			if sd.sector == nil {
+				if unlocated == nil {
+					unlocated = make(map[int64]*sectorDeal)
+				}
+				unlocated[sd.dealID] = sd
+			}
+		}
+		if len(unlocated) > 0 {
+			sectors, err := run.api.StateMinerSectors(ctx, sp, nil, run.lts.Key())
 			if err != nil {
-				return err
+				return nil, xerrors.Errorf("retrieving sectors of %s failed: %w", sp, err)
+			}
+			for _, si := range sectors {
+				for _, dID := range si.DealIDs {
+					if sd, found := unlocated[int64(dID)]; found {
+						num := si.SectorNumber
+						sd.sector = &num
+					}
+				}
 			}
 		}
 
-		// we may have some terminations ( no longer in the market state )
-		toFail := make([]int64, 0, len(knownDeals))
-		for dID, d := range knownDeals {
-			dealTotals["terminated"]++
-			if d.status == "terminated" {
+		for _, sd := range deals {
+			if sd.sector == nil {
+				sectorStates["unlocated"]++
 				continue
 			}
-			terminatedDealCount++
-			toFail = append(toFail, dID)
-		}
-		if len(toFail) > 0 {
-			_, err = cargoDb.Exec(
+
+			var expiration *filabi.ChainEpoch
+			state := "healthy"
+			si, err := run.api.StateSectorGetInfo(ctx, sp, *sd.sector, run.lts.Key())
+			if err != nil {
+				return nil, xerrors.Errorf("retrieving info of sector %d of %s failed: %w", *sd.sector, sp, err)
+			}
+			if si == nil {
+				state = "terminated"
+			} else {
+				expiration = &si.Expiration
+				if isFaulty, err := faults.IsSet(uint64(*sd.sector)); err != nil {
+					return nil, err
+				} else if isFaulty {
+					state = "faulty"
+				}
+			}
+			sectorStates[state]++
+
+			if _, err := cargoDb.Exec(
 				ctx,
 				`
 				UPDATE cargo.deals SET
-					status = $1,
-					status_meta = $2
-				WHERE
-					deal_id = ANY ( $3::BIGINT[] )
-						AND
-					status != 'terminated'
+					sector_number = $1,
+					sector_expiration_epoch = COALESCE( $2, sector_expiration_epoch ),
+					sector_state = $3
+				WHERE deal_id = $4
 				`,
-				`terminated`,
-				`deal no longer part of market-actor state`,
-				toFail,
-			)
-			if err != nil {
-				return err
+				*sd.sector,
+				expiration,
+				state,
+				sd.dealID,
+			); err != nil {
+				return nil, err
 			}
 		}
+	}
 
-		return nil
-	},
+	return sectorStates, nil
+}
+
+// updateProviderScorecards snapshots cargo.provider_scorecard into each
+// provider's details, leaving any other keys in place
+func updateProviderScorecards(ctx context.Context) (int64, error) {
+	res, err := cargoDb.Exec(
+		ctx,
+		`
+		UPDATE cargo.providers p SET
+			details = JSONB_SET(
+				COALESCE( p.details, '{}' ),
+				'{scorecard}',
+				( TO_JSONB( s ) - 'provider' ) || JSONB_BUILD_OBJECT( 'computed_at', NOW() )
+			)
+		FROM cargo.provider_scorecard s
+		WHERE p.provider = s.provider
+		`,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected(), nil
 }
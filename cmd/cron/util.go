@@ -2,21 +2,23 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
+	"text/template"
 	"time"
 
-	"github.com/filecoin-project/go-jsonrpc"
 	filabi "github.com/filecoin-project/go-state-types/abi"
 	lotusapi "github.com/filecoin-project/lotus/api"
 	filbuild "github.com/filecoin-project/lotus/build"
 	filtypes "github.com/filecoin-project/lotus/chain/types"
-	filactors "github.com/filecoin-project/specs-actors/actors/builtin"
 	"github.com/hashicorp/go-retryablehttp"
 	"github.com/ipfs/go-cid"
 	ipfsapi "github.com/ipfs/go-ipfs-api"
 	logging "github.com/ipfs/go-log/v2"
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/mattn/go-isatty"
 	"github.com/urfave/cli/v2"
@@ -81,7 +83,56 @@ func cidListFromQuery(ctx context.Context, sql string, args ...interface{}) (map
 	return cidList, nil
 }
 
-func mainnetTime(e filabi.ChainEpoch) time.Time { return time.Unix(int64(e)*30+1598306400, 0) }
+// the filecoin network the lotus node follows, populated by lotusAPI()
+type filNetwork struct {
+	name       string
+	genesis    time.Time
+	blockDelay time.Duration
+}
+
+var filNet filNetwork
+
+func (n filNetwork) epochTime(e filabi.ChainEpoch) time.Time {
+	return n.genesis.Add(time.Duration(e) * n.blockDelay)
+}
+
+func (n filNetwork) epochsIn(d time.Duration) filabi.ChainEpoch {
+	return filabi.ChainEpoch(d / n.blockDelay)
+}
+
+type aggregateLocationVars struct {
+	AggregateCid string
+	PieceCid     string
+	Md5hex       string
+}
+
+func aggregateCarName(md5hex, pieceCid string) string {
+	return fmt.Sprintf("%s_%s.car", md5hex, pieceCid)
+}
+
+func aggregateManifestName(md5hex, pieceCid string) string {
+	return fmt.Sprintf("%s_%s%s", md5hex, pieceCid, manifestSidecarSuffix)
+}
+
+func aggregateLocation(cctx *cli.Context, aggregateCid, pieceCid, md5hex string) (string, error) {
+	tplStr := cctx.String("aggregate-location-template")
+	if tplStr == "" {
+		return "", xerrors.New("no aggregate-location-template configured")
+	}
+	tpl, err := template.New("location").Parse(tplStr)
+	if err != nil {
+		return "", xerrors.Errorf("unable to parse aggregate-location-template: %w", err)
+	}
+	var loc strings.Builder
+	if err := tpl.Execute(&loc, aggregateLocationVars{
+		AggregateCid: aggregateCid,
+		PieceCid:     pieceCid,
+		Md5hex:       md5hex,
+	}); err != nil {
+		return "", err
+	}
+	return loc.String(), nil
+}
 
 func ipfsAPI(cctx *cli.Context) *ipfsapi.Shell {
 	s := ipfsapi.NewShell(cctx.String("ipfs-api"))
@@ -89,18 +140,95 @@ func ipfsAPI(cctx *cli.Context) *ipfsapi.Shell {
 	return s
 }
 
-func lotusAPI(cctx *cli.Context) (api *lotusapi.FullNodeStruct, closer func(), err error) {
-	api = new(lotusapi.FullNodeStruct)
-	closer, err = jsonrpc.NewMergeClient(cctx.Context, cctx.String("lotus-api")+"/rpc/v0", "Filecoin", []interface{}{&api.Internal, &api.CommonStruct.Internal}, nil)
+func recursivePins(cctx *cli.Context) (map[cid.Cid]struct{}, error) {
+	var res struct{ Keys map[string]ipfsapi.PinInfo }
+	if err := ipfsAPI(cctx).Request("pin/ls").Option("type", "recursive").Option("quiet", "true").Exec(cctx.Context, &res); err != nil {
+		return nil, err
+	}
+	pins := make(map[cid.Cid]struct{}, len(res.Keys))
+	for cidStr := range res.Keys {
+		c, err := cid.Parse(cidStr)
+		if err != nil {
+			return nil, err
+		}
+		pins[cidv1(c)] = struct{}{}
+	}
+	return pins, nil
+}
+
+// initFilNetwork derives genesis time and block delay from the chain unless
+// configured explicitly, and ensures they match what the database was set up with
+func initFilNetwork(cctx *cli.Context, api *lotusapi.FullNodeStruct) error {
+	ctx := cctx.Context
+
+	netName, err := api.StateNetworkName(ctx)
 	if err != nil {
-		api = nil
-		closer = nil
+		return xerrors.Errorf("failed getting network name: %w", err)
+	}
+
+	genesisUnix := cctx.Int64("filecoin-genesis-unix")
+	if genesisUnix == 0 {
+		gts, err := api.ChainGetGenesis(ctx)
+		if err != nil {
+			return xerrors.Errorf("failed getting genesis: %w", err)
+		}
+		genesisUnix = int64(gts.MinTimestamp())
+	}
+
+	blockDelay := int64(cctx.Uint("filecoin-block-delay-seconds"))
+	if blockDelay == 0 {
+		// every block timestamp is exactly genesis + height * delay
+		head, err := api.ChainHead(ctx)
+		if err != nil {
+			return xerrors.Errorf("failed getting chain head: %w", err)
+		}
+		if head.Height() == 0 {
+			return xerrors.New("unable to derive block delay at genesis, set filecoin-block-delay-seconds")
+		}
+		blockDelay = (int64(head.MinTimestamp()) - genesisUnix) / int64(head.Height())
 	}
-	return
+
+	if _, err := cargoDb.Exec(
+		ctx,
+		`
+		INSERT INTO cargo.network_params ( network_name, genesis_unix, block_delay_seconds ) VALUES ( $1, $2, $3 )
+			ON CONFLICT ( singleton ) DO NOTHING
+		`,
+		string(netName),
+		genesisUnix,
+		blockDelay,
+	); err != nil {
+		return err
+	}
+
+	var dbName string
+	var dbGenesis, dbDelay int64
+	if err := cargoDb.QueryRow(
+		ctx,
+		`SELECT network_name, genesis_unix, block_delay_seconds FROM cargo.network_params`,
+	).Scan(&dbName, &dbGenesis, &dbDelay); err != nil {
+		return err
+	}
+	if dbName != string(netName) || dbGenesis != genesisUnix || dbDelay != blockDelay {
+		return xerrors.Errorf(
+			"lotus reports network '%s' with genesis %d and block delay %ds, while the database was set up for '%s' with genesis %d and block delay %ds",
+			netName, genesisUnix, blockDelay,
+			dbName, dbGenesis, dbDelay,
+		)
+	}
+
+	filNet = filNetwork{
+		name:       string(netName),
+		genesis:    time.Unix(genesisUnix, 0),
+		blockDelay: time.Duration(blockDelay) * time.Second,
+	}
+	return nil
 }
 
-func lotusLookbackTipset(cctx *cli.Context, api *lotusapi.FullNodeStruct) (*filtypes.TipSet, error) {
-	latestHead, err := api.ChainHead(cctx.Context)
+// lotusSyncedHead returns the current head, or an error if its timestamp
+// is too far from walltime
+func lotusSyncedHead(ctx context.Context, api *lotusapi.FullNodeStruct) (*filtypes.TipSet, error) {
+	latestHead, err := api.ChainHead(ctx)
 	if err != nil {
 		return nil, xerrors.Errorf("failed getting chain head: %w", err)
 	}
@@ -111,7 +239,7 @@ func lotusLookbackTipset(cctx *cli.Context, api *lotusapi.FullNodeStruct) (*filt
 	if wallUnix < filUnix ||
 		wallUnix > filUnix+int64(
 			// allow up to 2 nul tipsets in a row ( 3 is virtually impossible )
-			filbuild.PropagationDelaySecs+(2*filactors.EpochDurationSeconds),
+			filbuild.PropagationDelaySecs+(2*uint64(filNet.blockDelay/time.Second)),
 		) {
 		return nil, xerrors.Errorf(
 			"lotus API out of sync: chainHead reports unixtime %d (height: %d) while walltime is %d (delta: %s)",
@@ -122,6 +250,15 @@ func lotusLookbackTipset(cctx *cli.Context, api *lotusapi.FullNodeStruct) (*filt
 		)
 	}
 
+	return latestHead, nil
+}
+
+func lotusLookbackTipset(cctx *cli.Context, api *lotusapi.FullNodeStruct) (*filtypes.TipSet, error) {
+	latestHead, err := lotusSyncedHead(cctx.Context, api)
+	if err != nil {
+		return nil, err
+	}
+
 	latestHeight := latestHead.Height()
 
 	tipsetAtLookback, err := api.ChainGetTipSetByHeight(cctx.Context, latestHeight-filabi.ChainEpoch(cctx.Uint("lotus-lookback-epochs")), latestHead.Key())
@@ -169,3 +306,41 @@ func (a *authorizer) RoundTrip(rq *http.Request) (*http.Response, error) {
 	}
 	return t.RoundTrip(rq)
 }
+
+// loadRuntimeState unmarshals the JSON stored under stateKey into dst, returning
+// false if nothing was stored yet
+func loadRuntimeState(ctx context.Context, stateKey string, dst interface{}) (bool, error) {
+	var raw []byte
+	err := cargoDb.QueryRow(
+		ctx,
+		`SELECT state FROM cargo.runtime_state WHERE state_key = $1`,
+		stateKey,
+	).Scan(&raw)
+	if err == pgx.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(raw, dst); err != nil {
+		return false, xerrors.Errorf("decoding runtime state '%s' failed: %w", stateKey, err)
+	}
+	return true, nil
+}
+
+func saveRuntimeState(ctx context.Context, stateKey string, src interface{}) error {
+	raw, err := json.Marshal(src)
+	if err != nil {
+		return err
+	}
+	_, err = cargoDb.Exec(
+		ctx,
+		`
+		INSERT INTO cargo.runtime_state ( state_key, state ) VALUES ( $1, $2 )
+			ON CONFLICT ( state_key ) DO UPDATE SET
+				state = EXCLUDED.state
+		`,
+		stateKey,
+		raw,
+	)
+	return err
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	filaddr "github.com/filecoin-project/go-address"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	filtypes "github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+)
+
+// Since network version 17 ( FIP-0045 ) DataCap can be spent on allocations
+// claimed by providers directly, without going through a market deal. The
+// lotus API we build against predates this: verifRegAPI declares the two
+// methods we need, with the JSON shapes newer nodes return. A claim carries
+// the id of the allocation it fulfilled.
+type verifRegAllocation struct {
+	Client     filabi.ActorID
+	Provider   filabi.ActorID
+	Data       cid.Cid
+	Size       filabi.PaddedPieceSize
+	TermMin    filabi.ChainEpoch
+	TermMax    filabi.ChainEpoch
+	Expiration filabi.ChainEpoch
+}
+
+type verifRegClaim struct {
+	Provider  filabi.ActorID
+	Client    filabi.ActorID
+	Data      cid.Cid
+	Size      filabi.PaddedPieceSize
+	TermMin   filabi.ChainEpoch
+	TermMax   filabi.ChainEpoch
+	TermStart filabi.ChainEpoch
+	Sector    filabi.SectorNumber
+}
+
+type verifRegAPI struct {
+	Internal struct {
+		StateGetAllocations func(ctx context.Context, clientAddr filaddr.Address, tsk filtypes.TipSetKey) (map[uint64]verifRegAllocation, error)
+		StateGetClaims      func(ctx context.Context, providerAddr filaddr.Address, tsk filtypes.TipSetKey) (map[uint64]verifRegClaim, error)
+	}
+}
+
+// nodes older than the network upgrade simply do not know these methods
+func isLotusMethodNotFound(err error, method string) bool {
+	return strings.Contains(err.Error(), "method 'Filecoin."+method+"' not found")
+}
+
+type verifiedReplica struct {
+	client, provider filaddr.Address
+	pieceCid         cid.Cid
+	status           string
+	termMin, termMax filabi.ChainEpoch
+	termStart        *filabi.ChainEpoch
+	sector           *filabi.SectorNumber
+	expiration       *filabi.ChainEpoch
+}
+
+// trackVerifiedReplicas records every allocation made by our clients, and every
+// claim held by a known provider, that references one of our pieces. Replicas
+// seen as live previously but gone now are retired.
+func (run *dealTrackingRun) trackVerifiedReplicas(ctx context.Context) (map[string]int64, error) {
+	lts := run.lts
+	counts := make(map[string]int64)
+	seen := make(map[uint64]verifiedReplica)
+
+	rows, err := cargoDb.Query(
+		ctx,
+		`
+		SELECT client
+			FROM cargo.clients
+		WHERE own OR NOT EXISTS ( SELECT 42 FROM cargo.clients WHERE own )
+		`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var clients []filaddr.Address
+	for rows.Next() {
+		var c string
+		if err := rows.Scan(&c); err != nil {
+			return nil, err
+		}
+		a, err := filaddr.NewFromString(c)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for _, c := range clients {
+		allocs, err := run.verifreg.Internal.StateGetAllocations(ctx, c, lts.Key())
+		if err != nil {
+			if isLotusMethodNotFound(err, "StateGetAllocations") {
+				log.Warn("lotus node does not support verified registry allocations, skipping direct onboarding tracking")
+				return nil, nil
+			}
+			return nil, xerrors.Errorf("retrieving allocations of client %s failed: %w", c, err)
+		}
+		for id, a := range allocs {
+			a := a
+			if _, known := run.aggCidLookup[a.Data]; !known {
+				continue
+			}
+			vr := verifiedReplica{
+				pieceCid:   a.Data,
+				status:     "allocated",
+				termMin:    a.TermMin,
+				termMax:    a.TermMax,
+				expiration: &a.Expiration,
+			}
+			if vr.client, err = filaddr.NewIDAddress(uint64(a.Client)); err != nil {
+				return nil, err
+			}
+			if vr.provider, err = filaddr.NewIDAddress(uint64(a.Provider)); err != nil {
+				return nil, err
+			}
+			// an allocation past its expiration can no longer be claimed
+			if a.Expiration <= lts.Height() {
+				vr.status = "expired"
+			}
+			seen[id] = vr
+		}
+	}
+
+	// every provider of a recorded replica must exist, before we list the providers to scan
+	for _, vr := range seen {
+		if _, err := cargoDb.Exec(
+			ctx,
+			`
+			INSERT INTO cargo.providers ( provider ) VALUES ( $1 )
+				ON CONFLICT ( provider ) DO NOTHING
+			`,
+			vr.provider.String(),
+		); err != nil {
+			return nil, err
+		}
+	}
+
+	providers, err := eligibleProviders(ctx, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, sp := range providers {
+		claims, err := run.verifreg.Internal.StateGetClaims(ctx, sp, lts.Key())
+		if err != nil {
+			if isLotusMethodNotFound(err, "StateGetClaims") {
+				log.Warn("lotus node does not support verified registry claims, skipping direct onboarding tracking")
+				return nil, nil
+			}
+			return nil, xerrors.Errorf("retrieving claims of provider %s failed: %w", sp, err)
+		}
+		for id, c := range claims {
+			c := c
+			if _, known := run.aggCidLookup[c.Data]; !known {
+				continue
+			}
+			vr := verifiedReplica{
+				provider:  sp,
+				pieceCid:  c.Data,
+				status:    "claimed",
+				termMin:   c.TermMin,
+				termMax:   c.TermMax,
+				termStart: &c.TermStart,
+				sector:    &c.Sector,
+			}
+			if vr.client, err = filaddr.NewIDAddress(uint64(c.Client)); err != nil {
+				return nil, err
+			}
+			if c.TermStart+c.TermMax <= lts.Height() {
+				vr.status = "expired"
+			}
+			seen[id] = vr
+		}
+	}
+
+	for id, vr := range seen {
+		fc, err := run.lookupClient(ctx, vr.client)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := cargoDb.Exec(
+			ctx,
+			`
+			INSERT INTO cargo.verified_replicas ( allocation_id, aggregate_cid, client, provider, status, term_min, term_max, term_start, sector_number, allocation_expiration, status_observed_epoch )
+				VALUES ( $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11 )
+			ON CONFLICT ( allocation_id ) DO UPDATE SET
+				status = EXCLUDED.status,
+				term_max = EXCLUDED.term_max,
+				term_start = COALESCE( EXCLUDED.term_start, cargo.verified_replicas.term_start ),
+				sector_number = COALESCE( EXCLUDED.sector_number, cargo.verified_replicas.sector_number ),
+				allocation_expiration = COALESCE( cargo.verified_replicas.allocation_expiration, EXCLUDED.allocation_expiration ),
+				status_observed_epoch = CASE WHEN cargo.verified_replicas.status IS DISTINCT FROM EXCLUDED.status THEN EXCLUDED.status_observed_epoch ELSE cargo.verified_replicas.status_observed_epoch END
+			`,
+			int64(id),
+			run.aggCidLookup[vr.pieceCid].String(),
+			fc.robust.String(),
+			vr.provider.String(),
+			vr.status,
+			vr.termMin,
+			vr.termMax,
+			vr.termStart,
+			vr.sector,
+			vr.expiration,
+			lts.Height(),
+		); err != nil {
+			return nil, err
+		}
+		counts[vr.status]++
+	}
+
+	seenIDs := make([]int64, 0, len(seen))
+	for id := range seen {
+		seenIDs = append(seenIDs, int64(id))
+	}
+
+	// an allocation vanishing without a claim showing up was removed after expiring,
+	// a claim vanishing before its maximum term was dropped along with its sector
+	retired, err := cargoDb.Exec(
+		ctx,
+		`
+		UPDATE cargo.verified_replicas SET
+			status = CASE WHEN status = 'claimed' AND term_start + term_max > $1 THEN 'terminated' ELSE 'expired' END,
+			status_observed_epoch = $1
+		WHERE
+			status IN ( 'allocated', 'claimed' )
+				AND
+			NOT allocation_id = ANY ( $2::BIGINT[] )
+		`,
+		lts.Height(),
+		seenIDs,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if retired.RowsAffected() > 0 {
+		counts["retired"] = retired.RowsAffected()
+	}
+
+	return counts, nil
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dustin/go-humanize"
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car"
+	sha256simd "github.com/minio/sha256-simd"
+	"github.com/mitchellh/go-homedir"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+)
+
+type aggregateRecord struct {
+	aggregateCid cid.Cid
+	pieceCid     cid.Cid
+	exportSize   uint64
+	pieceSize    filabi.PaddedPieceSize
+	sha256hex    string
+	md5hex       string
+	entries      map[cid.Cid]struct{}
+}
+
+type carStreamStats struct {
+	size      uint64
+	pieceSize filabi.PaddedPieceSize
+	commp     cid.Cid
+	sha256    []byte
+	md5       []byte
+	roots     []cid.Cid
+	blocks    uint64
+	missing   []cid.Cid
+}
+
+var verifyAggregates = &cli.Command{
+	Usage:     "Verify exported aggregate car files against their database records",
+	Name:      "verify-aggregates",
+	ArgsUsage: "[aggregate_cid ...]",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "source",
+			Usage: "Where to stream car files from: 'local' (export-dir), 'http' (aggregate-location-template) or 's3' (rclone remote)",
+			Value: "local",
+		},
+		&cli.PathFlag{
+			Name:  "export-dir",
+			Usage: "Directory holding exported .car files when --source=local",
+		},
+		&cli.StringFlag{
+			Name:  "s3-remote",
+			Usage: "rclone remote:path holding offloaded .car files when --source=s3",
+			Value: "cargo_r2:/dagcargo",
+		},
+		&cli.StringFlag{
+			Name:  "rclone-exec",
+			Usage: "Command used to invoke rclone when --source=s3",
+			Value: "rclone",
+		},
+		&cli.UintFlag{
+			Name:  "created-within-days",
+			Usage: "When no aggregate_cids are given verify only aggregates created that many days ago or later (0 means all)",
+		},
+		&cli.UintFlag{
+			Name:  "max-concurrent-verifications",
+			Usage: "Amount of car files to stream at the same time",
+			Value: 4,
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+
+		ctx, closer := context.WithCancel(cctx.Context)
+		defer closer()
+
+		var openCar func(ctx context.Context, a *aggregateRecord) (io.ReadCloser, error)
+		switch cctx.String("source") {
+		case "local":
+			dir, err := homedir.Expand(cctx.Path("export-dir"))
+			if err != nil {
+				return err
+			}
+			if dir == "" {
+				return xerrors.New("--export-dir is required when --source=local")
+			}
+			openCar = func(_ context.Context, a *aggregateRecord) (io.ReadCloser, error) {
+				return os.Open(dir + "/" + aggregateCarName(a.md5hex, a.pieceCid.String()))
+			}
+		case "http":
+			client := retryingClient("")
+			openCar = func(ctx context.Context, a *aggregateRecord) (io.ReadCloser, error) {
+				loc, err := aggregateLocation(cctx, a.aggregateCid.String(), a.pieceCid.String(), a.md5hex)
+				if err != nil {
+					return nil, err
+				}
+				req, err := http.NewRequestWithContext(ctx, http.MethodGet, loc, nil)
+				if err != nil {
+					return nil, err
+				}
+				resp, err := client.Do(req)
+				if err != nil {
+					return nil, err
+				}
+				if resp.StatusCode != http.StatusOK {
+					resp.Body.Close() //nolint:errcheck
+					return nil, xerrors.Errorf("unexpected HTTP status '%s' from %s", resp.Status, loc)
+				}
+				return resp.Body, nil
+			}
+		case "s3":
+			rcloneCmd := strings.Fields(cctx.String("rclone-exec"))
+			if len(rcloneCmd) == 0 {
+				return xerrors.New("--rclone-exec can not be empty")
+			}
+			openCar = func(ctx context.Context, a *aggregateRecord) (io.ReadCloser, error) {
+				cmd := exec.CommandContext(ctx, rcloneCmd[0], append(
+					rcloneCmd[1:],
+					"cat",
+					cctx.String("s3-remote")+"/"+aggregateCarName(a.md5hex, a.pieceCid.String()),
+				)...)
+				return startStreamingCmd(cmd)
+			}
+		default:
+			return xerrors.Errorf("unknown car source '%s'", cctx.String("source"))
+		}
+
+		aggs, err := aggregateRecords(ctx, cctx.Args().Slice(), cctx.Uint("created-within-days"))
+		if err != nil {
+			return err
+		}
+
+		var verifiedCount, failedCount, verifiedBytes uint64
+		defer func() {
+			log.Infow("summary",
+				"source", cctx.String("source"),
+				"selectedAggregates", len(aggs),
+				"verified", atomic.LoadUint64(&verifiedCount),
+				"verifiedBytes", atomic.LoadUint64(&verifiedBytes),
+				"failed", atomic.LoadUint64(&failedCount),
+			)
+		}()
+
+		if len(aggs) == 0 {
+			return nil
+		}
+		log.Infof("verifying %s aggregates from source '%s'", humanize.Comma(int64(len(aggs))), cctx.String("source"))
+
+		todoCh := make(chan *aggregateRecord, len(aggs))
+		for _, a := range aggs {
+			todoCh <- a
+		}
+		close(todoCh)
+
+		var wg sync.WaitGroup
+		for i := uint(0); i < cctx.Uint("max-concurrent-verifications"); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					a, chanOpen := <-todoCh
+					if !chanOpen || ctx.Err() != nil {
+						return
+					}
+
+					mismatches, err := verifyAggregate(ctx, a, openCar)
+					if err != nil {
+						mismatches = append(mismatches, "unable to stream car: "+err.Error())
+					}
+
+					if len(mismatches) > 0 {
+						atomic.AddUint64(&failedCount, 1)
+						log.Warnw("aggregate verification FAILED",
+							"aggregate", a.aggregateCid.String(),
+							"piece", a.pieceCid.String(),
+							"mismatches", mismatches,
+						)
+					} else {
+						atomic.AddUint64(&verifiedCount, 1)
+						atomic.AddUint64(&verifiedBytes, a.exportSize)
+						log.Infow("aggregate verified", "aggregate", a.aggregateCid.String(), "piece", a.pieceCid.String())
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if failedCount > 0 {
+			return xerrors.Errorf("%d out of %d aggregates failed verification", failedCount, len(aggs))
+		}
+		return nil
+	},
+}
+
+func aggregateRecords(ctx context.Context, aggCidStrs []string, createdWithinDays uint) ([]*aggregateRecord, error) {
+
+	var cond string
+	var args []interface{}
+	if len(aggCidStrs) > 0 {
+		cond = `a.aggregate_cid = ANY( $1::TEXT[] )`
+		args = append(args, aggCidStrs)
+	} else if createdWithinDays > 0 {
+		cond = `a.entry_created > NOW() - $1::INTERVAL`
+		args = append(args, fmt.Sprintf("%d days", createdWithinDays))
+	} else {
+		cond = `TRUE`
+	}
+
+	rows, err := cargoDb.Query(
+		ctx,
+		fmt.Sprintf(
+			`
+			SELECT a.aggregate_cid, a.piece_cid, a.export_size, a.piece_size, a.metadata->>'sha256hex', a.metadata->>'md5hex', ae.cid_v1
+				FROM cargo.aggregates a
+				JOIN cargo.aggregate_entries ae USING ( aggregate_cid )
+			WHERE %s
+			ORDER BY a.entry_created, a.aggregate_cid
+			`,
+			cond,
+		),
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	seen := make(map[string]*aggregateRecord)
+	aggs := make([]*aggregateRecord, 0, 1024)
+	for rows.Next() {
+		var aCidStr, pCidStr, sha256hex, md5hex, eCidStr string
+		var exportSize uint64
+		var pieceSize filabi.PaddedPieceSize
+		if err = rows.Scan(&aCidStr, &pCidStr, &exportSize, &pieceSize, &sha256hex, &md5hex, &eCidStr); err != nil {
+			return nil, err
+		}
+
+		a, known := seen[aCidStr]
+		if !known {
+			a = &aggregateRecord{
+				exportSize: exportSize,
+				pieceSize:  pieceSize,
+				sha256hex:  sha256hex,
+				md5hex:     md5hex,
+				entries:    make(map[cid.Cid]struct{}),
+			}
+			if a.aggregateCid, err = cid.Parse(aCidStr); err != nil {
+				return nil, err
+			}
+			if a.pieceCid, err = cid.Parse(pCidStr); err != nil {
+				return nil, err
+			}
+			seen[aCidStr] = a
+			aggs = append(aggs, a)
+		}
+
+		eCid, err := cid.Parse(eCidStr)
+		if err != nil {
+			return nil, err
+		}
+		a.entries[cidv1(eCid)] = struct{}{}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(aggCidStrs) > 0 && len(aggs) != len(aggCidStrs) {
+		return nil, xerrors.Errorf("only %d out of the %d requested aggregates are known", len(aggs), len(aggCidStrs))
+	}
+
+	return aggs, nil
+}
+
+func verifyAggregate(ctx context.Context, a *aggregateRecord, openCar func(context.Context, *aggregateRecord) (io.ReadCloser, error)) ([]string, error) {
+
+	carRdr, err := openCar(ctx, a)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := carStreamAnalyze(ctx, carRdr, a.entries)
+	closeErr := carRdr.Close()
+	if err != nil {
+		if closeErr != nil {
+			err = xerrors.Errorf("%w (%s)", err, closeErr)
+		}
+		return nil, err
+	}
+	if closeErr != nil {
+		return nil, closeErr
+	}
+
+	mismatches := make([]string, 0)
+	if st.size != a.exportSize {
+		mismatches = append(mismatches, fmt.Sprintf("size %d does not match recorded export_size %d", st.size, a.exportSize))
+	}
+	if !st.commp.Equals(a.pieceCid) {
+		mismatches = append(mismatches, fmt.Sprintf("commP %s does not match recorded piece_cid %s", st.commp, a.pieceCid))
+	}
+	if st.pieceSize != a.pieceSize {
+		mismatches = append(mismatches, fmt.Sprintf("padded piece size %d does not match recorded piece_size %d", st.pieceSize, a.pieceSize))
+	}
+	if hex.EncodeToString(st.sha256) != a.sha256hex {
+		mismatches = append(mismatches, fmt.Sprintf("sha256 %x does not match recorded %s", st.sha256, a.sha256hex))
+	}
+	if hex.EncodeToString(st.md5) != a.md5hex {
+		mismatches = append(mismatches, fmt.Sprintf("md5 %x does not match recorded %s", st.md5, a.md5hex))
+	}
+	if len(st.roots) != 1 || !st.roots[0].Equals(a.aggregateCid) {
+		mismatches = append(mismatches, fmt.Sprintf("car roots %s do not match recorded aggregate_cid %s", st.roots, a.aggregateCid))
+	}
+	if len(st.missing) > 0 {
+		mismatches = append(mismatches, fmt.Sprintf("%d out of %d aggregate entries are absent from car, including %s", len(st.missing), len(a.entries), st.missing[0]))
+	}
+
+	return mismatches, nil
+}
+
+// carStreamAnalyze reads an entire car stream, calculating all hashes we record
+// about it. Blocks are only validated by the car reader itself, which re-hashes
+// each one and fails the read on the first that does not match its CID.
+// The entries map is not modified.
+func carStreamAnalyze(ctx context.Context, carRdr io.Reader, entries map[cid.Cid]struct{}) (*carStreamStats, error) {
+
+	cp := new(commp.Calc)
+	sha := sha256simd.New()
+	md5 := md5.New()
+	cnt := new(countingWriter)
+
+	// everything the car reader consumes goes through the hashers as well
+	teeRdr := io.TeeReader(carRdr, io.MultiWriter(cp, sha, md5, cnt))
+
+	cr, err := car.NewCarReader(teeRdr)
+	if err != nil {
+		return nil, err
+	}
+
+	st := &carStreamStats{
+		roots: cr.Header.Roots,
+	}
+	for i := range st.roots {
+		st.roots[i] = cidv1(st.roots[i])
+	}
+
+	pending := make(map[cid.Cid]struct{}, len(entries))
+	for c := range entries {
+		pending[c] = struct{}{}
+	}
+
+	for {
+		if st.blocks%1024 == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+
+		blk, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		st.blocks++
+		delete(pending, cidv1(blk.Cid()))
+	}
+
+	// ensure any trailing bytes make it into the hashes
+	if _, err := io.CopyBuffer(io.Discard, teeRdr, make([]byte, 1<<20)); err != nil {
+		return nil, err
+	}
+
+	st.size = cnt.n
+	st.sha256 = sha.Sum(make([]byte, 0, 32))
+	st.md5 = md5.Sum(make([]byte, 0, 20))
+
+	rawCommp, paddedSize, err := cp.Digest()
+	if err != nil {
+		return nil, err
+	}
+	if st.commp, err = commcid.DataCommitmentV1ToCID(rawCommp); err != nil {
+		return nil, err
+	}
+	st.pieceSize = filabi.PaddedPieceSize(paddedSize)
+
+	for c := range pending {
+		st.missing = append(st.missing, c)
+	}
+
+	return st, nil
+}
+
+type countingWriter struct{ n uint64 }
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	w.n += uint64(len(b))
+	return len(b), nil
+}
+
+type cmdStream struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+}
+
+func startStreamingCmd(cmd *exec.Cmd) (io.ReadCloser, error) {
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &cmdStream{ReadCloser: stdout, cmd: cmd, stderr: stderr}, nil
+}
+
+func (s *cmdStream) Close() error {
+	s.ReadCloser.Close() //nolint:errcheck
+	if err := s.cmd.Wait(); err != nil {
+		return xerrors.Errorf("%s failed: %w: %s", s.cmd.Path, err, strings.TrimSpace(s.stderr.String()))
+	}
+	return nil
+}
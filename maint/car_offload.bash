@@ -48,6 +48,12 @@ CARGO_NGINX_REDIRECTS_INCLUDE="/srv/cargo/ETC/car_redirects"
 # tell nginx to reread the 301 list
 /etc/init.d/nginx reload >/dev/null
 
-# delete everything local that matches its md5
+# delete every car that matches the md5 in its name
   comm -12 <( ls "$LOCAL_SRC" | sort ) <( $RCLONE_EXEC lsf "$REMOTE_DST" | sort ) \
-| xargs -n1 -I{} bash -c "$RCLONE_EXEC md5sum $REMOTE_DST/{} | perl -e 'my (\$md5, \$md5fn) = <> =~ /(\S+)\s+([^_]+)/; exit 1 if \$md5 ne \$md5fn' && rm $LOCAL_SRC/{}"
+| ( grep -E '\.car$' || true ) \
+| xargs -n1 -I{} bash -c "if $RCLONE_EXEC md5sum $REMOTE_DST/{} | perl -e 'my (\$md5, \$md5fn) = <> =~ /(\S+)\s+([^_]+)/; exit 1 if \$md5 ne \$md5fn'; then rm $LOCAL_SRC/{}; fi"
+
+# manifest sidecars carry the md5 of their car, not their own: compare against the local copy
+  comm -12 <( ls "$LOCAL_SRC" | sort ) <( $RCLONE_EXEC lsf "$REMOTE_DST" | sort ) \
+| ( grep -E '\.manifest\.ndjson$' || true ) \
+| xargs -n1 -I{} bash -c "if [[ \"\$( $RCLONE_EXEC md5sum $REMOTE_DST/{} | cut -d' ' -f1 )\" == \"\$( md5sum $LOCAL_SRC/{} | cut -d' ' -f1 )\" ]]; then rm $LOCAL_SRC/{}; fi"
@@ -7,6 +7,10 @@ export pgconn="service=cargo-metrics-heavy"
 export wwwdir="$HOME/STATUS"
 export atcat="$( dirname "${BASH_SOURCE[0]}" )/atomic_cat.bash"
 
+# keep in line with target-replicas / renewal-horizon-days in dagcargo.toml
+export target_replicas="${TARGET_REPLICAS:-5}"
+export renewal_horizon_days="${RENEWAL_HORIZON_DAYS:-60}"
+
 ###
 ### Only execute one version of exporter concurrently
 ###
@@ -46,7 +50,7 @@ ex_pending_replication() {
       'export_payload', ( SELECT JSONB_AGG(j) FROM (
         SELECT *
           FROM cargo.aggregate_summary
-        WHERE tentative_replicas < 5
+        WHERE tentative_replicas < $target_replicas
       ) j )
     )" \
   | jq . \
@@ -54,14 +58,39 @@ ex_pending_replication() {
 }
 export -f ex_pending_replication
 
+ex_renewal_queue() {
+  psql $pgconn -At -c "
+    SELECT JSON_BUILD_OBJECT(
+      'export_timestamp', NOW(),
+      'export_type', 'renewal_queue',
+      'export_payload', ( SELECT JSONB_AGG(j) FROM (
+        SELECT *
+          FROM cargo.renewal_queue( $target_replicas, MAKE_INTERVAL( days => $renewal_horizon_days ) )
+      ) j )
+    )" \
+  | jq . \
+  | "$atcat" "$wwwdir/renewal_queue.json"
+}
+export -f ex_renewal_queue
+
 ex_deal_counts() {
   psql $pgconn -At -c "
     WITH
       per_client AS (
         SELECT client k, JSONB_OBJECT_AGG(status, count) v FROM (
           SELECT client, status, COUNT(*) AS count
-            FROM cargo.deals
-          WHERE status IN ( 'published', 'active' )
+            FROM cargo.own_deals
+          WHERE status IN ( 'published', 'active', 'expiring' )
+          GROUP BY client, status
+          ORDER BY client, status DESC
+        ) j
+        GROUP BY client
+      ),
+      per_foreign_client AS (
+        SELECT client k, JSONB_OBJECT_AGG(status, count) v FROM (
+          SELECT client, status, COUNT(*) AS count
+            FROM cargo.foreign_deals
+          WHERE status IN ( 'published', 'active', 'expiring' )
           GROUP BY client, status
           ORDER BY client, status DESC
         ) j
@@ -71,8 +100,8 @@ ex_deal_counts() {
         SELECT aggregate_cid k, JSONB_OBJECT_AGG( client, counts ) v FROM (
           SELECT aggregate_cid, client, JSONB_OBJECT_AGG( status, replicas ) counts FROM (
             SELECT aggregate_cid, client, status, COUNT(*) AS replicas
-              FROM cargo.deals
-            WHERE status IN ( 'published', 'active' )
+              FROM cargo.own_deals
+            WHERE status IN ( 'published', 'active', 'expiring' )
             GROUP BY aggregate_cid, client, status
             ORDER BY client, status DESC, aggregate_cid
           ) j
@@ -85,6 +114,7 @@ ex_deal_counts() {
       'export_type', 'deal_counts',
       'export_payload', JSONB_BUILD_OBJECT(
         'client_totals', ( SELECT JSONB_OBJECT_AGG( k, v ) FROM per_client ),
+        'foreign_client_totals', ( SELECT JSONB_OBJECT_AGG( k, v ) FROM per_foreign_client ),
         'aggregate_totals', ( SELECT JSONB_OBJECT_AGG( k, v ) FROM per_aggregate )
       )
     )" \
@@ -93,5 +123,37 @@ ex_deal_counts() {
 }
 export -f ex_deal_counts
 
-echo ex_per_source_usage ex_pending_replication ex_deal_counts \
+# attoFIL amounts are exported as strings, jq would mangle them as doubles
+ex_storage_costs() {
+  psql $pgconn -At -c "
+    SELECT JSON_BUILD_OBJECT(
+      'export_timestamp', NOW(),
+      'export_type', 'storage_costs',
+      'export_payload', JSONB_BUILD_OBJECT(
+        'per_project', ( SELECT JSONB_OBJECT_AGG( project, JSONB_BUILD_OBJECT(
+          'aggregates', aggregates,
+          'total_price_attofil', total_price::TEXT,
+          'provider_collateral_attofil', provider_collateral::TEXT,
+          'client_collateral_attofil', client_collateral::TEXT
+        ) ) FROM cargo.project_costs ),
+        'per_provider', ( SELECT JSONB_OBJECT_AGG( provider, JSONB_BUILD_OBJECT(
+          'deals', deals,
+          'total_price_attofil', total_price::TEXT,
+          'provider_collateral_attofil', provider_collateral::TEXT,
+          'client_collateral_attofil', client_collateral::TEXT
+        ) ) FROM cargo.provider_costs ),
+        'per_aggregate', ( SELECT JSONB_OBJECT_AGG( aggregate_cid, JSONB_BUILD_OBJECT(
+          'deals', deals,
+          'total_price_attofil', total_price::TEXT,
+          'provider_collateral_attofil', provider_collateral::TEXT,
+          'client_collateral_attofil', client_collateral::TEXT
+        ) ) FROM cargo.aggregate_costs )
+      )
+    )" \
+  | jq . \
+  | "$atcat" "$wwwdir/storage_costs.json"
+}
+export -f ex_storage_costs
+
+echo ex_per_source_usage ex_pending_replication ex_renewal_queue ex_deal_counts ex_storage_costs \
 | xargs -d ' ' -n1 -P4 -I{} bash -c {}
@@ -22,7 +22,85 @@ CREATE OR REPLACE
     LANGUAGE plpgsql
 AS $$
 BEGIN
-  INSERT INTO cargo.deal_events ( deal_id, status ) VALUES ( NEW.deal_id, NEW.status );
+  INSERT INTO cargo.deal_events ( deal_id, status, observed_epoch, observed_tipset_key, chain_epoch, message_cid )
+    VALUES (
+      NEW.deal_id,
+      NEW.status,
+      NEW.status_observed_epoch,
+      NEW.status_observed_tipset_key,
+      CASE NEW.status
+        WHEN 'published' THEN NEW.publish_epoch
+        WHEN 'active' THEN NEW.sector_start_epoch
+        WHEN 'slashed' THEN NEW.slash_epoch
+        WHEN 'expired' THEN NEW.end_epoch
+      END,
+      CASE WHEN NEW.status = 'published' THEN NEW.publish_message_cid END
+    );
+  RETURN NULL;
+END;
+$$;
+
+-- webhook_outbox gets one row per subscribed project and dag, for the first time each milestone is reached
+CREATE OR REPLACE
+  FUNCTION cargo.enqueue_analyzed_webhooks() RETURNS TRIGGER
+    LANGUAGE plpgsql
+AS $$
+BEGIN
+  INSERT INTO cargo.webhook_outbox ( project, cid_v1, milestone, payload )
+    SELECT DISTINCT s.project, NEW.cid_v1, 'analyzed', JSONB_BUILD_OBJECT( 'size', NEW.size_actual )
+      FROM cargo.dag_sources ds
+      JOIN cargo.sources s USING ( srcid )
+      JOIN cargo.webhook_subscriptions ws USING ( project )
+    WHERE ds.cid_v1 = NEW.cid_v1 AND ds.entry_removed IS NULL
+  ON CONFLICT ( project, cid_v1, milestone ) DO NOTHING;
+  RETURN NULL;
+END;
+$$;
+
+CREATE OR REPLACE
+  FUNCTION cargo.enqueue_aggregated_webhooks() RETURNS TRIGGER
+    LANGUAGE plpgsql
+AS $$
+BEGIN
+  INSERT INTO cargo.webhook_outbox ( project, cid_v1, milestone, payload )
+    SELECT DISTINCT s.project, NEW.cid_v1, 'aggregated', JSONB_BUILD_OBJECT( 'aggregate_cid', a.aggregate_cid, 'piece_cid', a.piece_cid )
+      FROM cargo.dag_sources ds
+      JOIN cargo.sources s USING ( srcid )
+      JOIN cargo.webhook_subscriptions ws USING ( project )
+      JOIN cargo.aggregates a ON a.aggregate_cid = NEW.aggregate_cid
+    WHERE ds.cid_v1 = NEW.cid_v1 AND ds.entry_removed IS NULL
+  ON CONFLICT ( project, cid_v1, milestone ) DO NOTHING;
+  RETURN NULL;
+END;
+$$;
+
+-- deal milestones only fire once a transition is final, so a reorg never takes one back
+-- a deal first seen as already active reaches both milestones at once
+CREATE OR REPLACE
+  FUNCTION cargo.enqueue_deal_webhooks() RETURNS TRIGGER
+    LANGUAGE plpgsql
+AS $$
+BEGIN
+  INSERT INTO cargo.webhook_outbox ( project, cid_v1, milestone, payload )
+    SELECT DISTINCT s.project, ae.cid_v1, m.milestone, JSONB_BUILD_OBJECT(
+      'aggregate_cid', a.aggregate_cid,
+      'piece_cid', a.piece_cid,
+      'deal_id', d.deal_id,
+      'provider', d.provider,
+      'chain_epoch', NEW.chain_epoch
+    )
+      FROM cargo.own_deals d
+      JOIN cargo.aggregates a USING ( aggregate_cid )
+      JOIN cargo.aggregate_entries ae USING ( aggregate_cid )
+      JOIN cargo.dag_sources ds ON ds.cid_v1 = ae.cid_v1 AND ds.entry_removed IS NULL
+      JOIN cargo.sources s ON s.srcid = ds.srcid
+      JOIN cargo.webhook_subscriptions ws USING ( project )
+      CROSS JOIN ( VALUES ( 'deal_published' ), ( 'deal_active' ) ) m ( milestone )
+    WHERE
+      d.deal_id = NEW.deal_id
+        AND
+      ( m.milestone = 'deal_published' OR NEW.status IN ( 'active', 'expiring' ) )
+  ON CONFLICT ( project, cid_v1, milestone ) DO NOTHING;
   RETURN NULL;
 END;
 $$;
@@ -60,6 +138,12 @@ CREATE TRIGGER trigger_dag_updated
   WHEN (OLD IS DISTINCT FROM NEW)
   EXECUTE PROCEDURE cargo.update_entry_timestamp()
 ;
+CREATE TRIGGER trigger_dag_analyzed_webhooks
+  AFTER UPDATE OF size_actual ON cargo.dags
+  FOR EACH ROW
+  WHEN (OLD.size_actual IS NULL AND NEW.size_actual IS NOT NULL)
+  EXECUTE PROCEDURE cargo.enqueue_analyzed_webhooks()
+;
 
 
 CREATE TABLE IF NOT EXISTS cargo.refs (
@@ -107,6 +191,7 @@ CREATE TABLE IF NOT EXISTS cargo.aggregates (
   aggregate_cid TEXT NOT NULL UNIQUE CONSTRAINT valid_aggregate_cid CHECK ( cargo.valid_cid_v1(aggregate_cid) ),
   piece_cid TEXT UNIQUE NOT NULL,
   export_size BIGINT NOT NULL CONSTRAINT valid_export_size CHECK ( export_size > 0 ),
+  piece_size BIGINT NOT NULL CONSTRAINT valid_piece_size CHECK ( piece_size >= 128 AND ( piece_size & ( piece_size - 1 ) ) = 0 ),
   metadata JSONB,
   entry_created TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
 );
@@ -119,14 +204,30 @@ CREATE TABLE IF NOT EXISTS cargo.aggregate_entries (
   CONSTRAINT singleton_aggregate_entry UNIQUE ( cid_v1, aggregate_cid )
 );
 CREATE INDEX IF NOT EXISTS aggregate_entries_aggregate_cid ON cargo.aggregate_entries ( aggregate_cid );
+CREATE TRIGGER trigger_aggregate_entry_webhooks
+  AFTER INSERT ON cargo.aggregate_entries
+  FOR EACH ROW
+  EXECUTE PROCEDURE cargo.enqueue_aggregated_webhooks()
+;
 
 
 CREATE TABLE IF NOT EXISTS cargo.clients (
   client TEXT NOT NULL UNIQUE CONSTRAINT valid_client_id CHECK ( SUBSTRING( client FROM 1 FOR 2 ) IN ( 'f1', 'f2', 'f3' ) ),
-  filp_available BIGINT NOT NULL,
+  filp_available NUMERIC NOT NULL,
+  own BOOLEAN NOT NULL DEFAULT false,
   details JSONB
 );
 
+-- one row per track-deals run for every one of our own clients
+CREATE TABLE IF NOT EXISTS cargo.client_datacap_log (
+  client TEXT NOT NULL REFERENCES cargo.clients ( client ),
+  filp_available NUMERIC NOT NULL,
+  epoch INTEGER NOT NULL,
+  recorded_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  CONSTRAINT singleton_client_epoch_reading UNIQUE ( client, epoch )
+);
+CREATE INDEX IF NOT EXISTS client_datacap_log_client_recorded_at ON cargo.client_datacap_log ( client, recorded_at );
+
 
 CREATE TABLE IF NOT EXISTS cargo.providers (
   provider TEXT NOT NULL UNIQUE CONSTRAINT valid_provider_id CHECK ( SUBSTRING( provider FROM 1 FOR 2 ) = 'f0' ),
@@ -134,6 +235,38 @@ CREATE TABLE IF NOT EXISTS cargo.providers (
 );
 
 
+-- single row, written by the cron on every lotus connection
+CREATE TABLE IF NOT EXISTS cargo.network_params (
+  singleton BOOLEAN NOT NULL UNIQUE DEFAULT true CONSTRAINT single_row CHECK ( singleton ),
+  network_name TEXT NOT NULL,
+  genesis_unix BIGINT NOT NULL,
+  block_delay_seconds INTEGER NOT NULL CONSTRAINT valid_block_delay CHECK ( block_delay_seconds > 0 )
+);
+
+CREATE OR REPLACE
+  FUNCTION cargo.epoch_to_timestamp(INTEGER) RETURNS TIMESTAMP WITH TIME ZONE
+    LANGUAGE sql STABLE PARALLEL SAFE
+AS $$
+  SELECT TO_TIMESTAMP( $1::BIGINT * block_delay_seconds + genesis_unix ) FROM cargo.network_params
+$$;
+
+CREATE OR REPLACE
+  FUNCTION cargo.update_deal_times() RETURNS TRIGGER
+    LANGUAGE plpgsql
+AS $$
+BEGIN
+  NEW.start_time = cargo.epoch_to_timestamp( NEW.start_epoch );
+  NEW.end_time = cargo.epoch_to_timestamp( NEW.end_epoch );
+  NEW.sector_start_time = cargo.epoch_to_timestamp( NEW.sector_start_epoch );
+  RETURN NEW;
+END;
+$$;
+
+
+-- publish_message_cid / publish_epoch are only known for deals discovered by walking the chain or
+-- from market events: deals first seen by a full scan of the market state leave them NULL
+-- verified, label and the amounts are always recorded, but are NULL for deals which left the market
+-- state before these columns existed ( see pg_upgrade.sql )
 CREATE TABLE IF NOT EXISTS cargo.deals (
   deal_id BIGINT UNIQUE NOT NULL CONSTRAINT valid_id CHECK ( deal_id > 0 ),
   aggregate_cid TEXT NOT NULL REFERENCES cargo.aggregates ( aggregate_cid ),
@@ -142,11 +275,24 @@ CREATE TABLE IF NOT EXISTS cargo.deals (
   status TEXT NOT NULL,
   status_meta TEXT,
   start_epoch INTEGER NOT NULL CONSTRAINT valid_start CHECK ( start_epoch > 0 ),
-  start_time TIMESTAMP WITH TIME ZONE NOT NULL GENERATED ALWAYS AS ( TO_TIMESTAMP( start_epoch*30 + 1598306400 ) ) STORED,
+  start_time TIMESTAMP WITH TIME ZONE NOT NULL,
   end_epoch INTEGER NOT NULL CONSTRAINT valid_end CHECK ( end_epoch > 0 ),
-  end_time TIMESTAMP WITH TIME ZONE NOT NULL GENERATED ALWAYS AS ( TO_TIMESTAMP( end_epoch*30 + 1598306400 ) ) STORED,
+  end_time TIMESTAMP WITH TIME ZONE NOT NULL,
   sector_start_epoch INTEGER CONSTRAINT valid_sector_start CHECK ( sector_start_epoch > 0 ),
-  sector_start_time TIMESTAMP WITH TIME ZONE GENERATED ALWAYS AS ( TO_TIMESTAMP( sector_start_epoch*30 + 1598306400 ) ) STORED,
+  sector_start_time TIMESTAMP WITH TIME ZONE,
+  slash_epoch INTEGER CONSTRAINT valid_slash CHECK ( slash_epoch > 0 ),
+  sector_number BIGINT CONSTRAINT valid_sector_number CHECK ( sector_number >= 0 ),
+  sector_expiration_epoch INTEGER CONSTRAINT valid_sector_expiration CHECK ( sector_expiration_epoch > 0 ),
+  sector_state TEXT CONSTRAINT valid_sector_state CHECK ( sector_state IN ( 'healthy', 'faulty', 'terminated' ) ),
+  verified BOOLEAN,
+  label TEXT,
+  price_per_epoch NUMERIC CONSTRAINT valid_price CHECK ( price_per_epoch >= 0 ),
+  provider_collateral NUMERIC CONSTRAINT valid_provider_collateral CHECK ( provider_collateral >= 0 ),
+  client_collateral NUMERIC CONSTRAINT valid_client_collateral CHECK ( client_collateral >= 0 ),
+  publish_message_cid TEXT,
+  publish_epoch INTEGER CONSTRAINT valid_publish_epoch CHECK ( publish_epoch > 0 ),
+  status_observed_epoch INTEGER NOT NULL,
+  status_observed_tipset_key TEXT[] NOT NULL,
   entry_created TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
   entry_last_updated TIMESTAMP WITH TIME ZONE NOT NULL
 );
@@ -154,6 +300,7 @@ CREATE INDEX IF NOT EXISTS deals_aggregate_cid ON cargo.deals ( aggregate_cid );
 CREATE INDEX IF NOT EXISTS deals_client ON cargo.deals ( client );
 CREATE INDEX IF NOT EXISTS deals_provider ON cargo.deals ( provider );
 CREATE INDEX IF NOT EXISTS deals_status ON cargo.deals ( status );
+CREATE INDEX IF NOT EXISTS deals_last_updated ON cargo.deals ( entry_last_updated, deal_id );
 CREATE TRIGGER trigger_deal_insert
   BEFORE INSERT ON cargo.deals
   FOR EACH ROW
@@ -168,9 +315,18 @@ CREATE TRIGGER trigger_deal_updated
     OLD.status_meta IS DISTINCT FROM NEW.status_meta
       OR
     OLD.sector_start_epoch IS DISTINCT FROM NEW.sector_start_epoch
+      OR
+    OLD.slash_epoch IS DISTINCT FROM NEW.slash_epoch
+      OR
+    OLD.sector_state IS DISTINCT FROM NEW.sector_state
   )
   EXECUTE PROCEDURE cargo.update_entry_timestamp()
 ;
+CREATE TRIGGER trigger_deal_times
+  BEFORE INSERT OR UPDATE OF start_epoch, end_epoch, sector_start_epoch ON cargo.deals
+  FOR EACH ROW
+  EXECUTE PROCEDURE cargo.update_deal_times()
+;
 CREATE TRIGGER trigger_basic_deal_history_on_insert
   AFTER INSERT ON cargo.deals
   FOR EACH ROW
@@ -184,13 +340,215 @@ CREATE TRIGGER trigger_basic_deal_history_on_update
 ;
 
 
+-- deals made by one of our own-client wallets count toward replication, foreign ones only get reported
+-- with no own clients configured every deal qualifies
+CREATE OR REPLACE VIEW cargo.own_deals AS (
+  SELECT d.*
+    FROM cargo.deals d
+    JOIN cargo.clients c USING ( client )
+  WHERE c.own OR NOT EXISTS ( SELECT 42 FROM cargo.clients WHERE own )
+);
+CREATE OR REPLACE VIEW cargo.foreign_deals AS (
+  SELECT d.*
+    FROM cargo.deals d
+    JOIN cargo.clients c USING ( client )
+  WHERE NOT c.own AND EXISTS ( SELECT 42 FROM cargo.clients WHERE own )
+);
+
+-- DataCap allocations and the claims providers make against them ( FIP-0045 direct onboarding )
+-- a claim carries the id of the allocation it fulfilled, so both share one row
+CREATE TABLE IF NOT EXISTS cargo.verified_replicas (
+  allocation_id BIGINT NOT NULL UNIQUE,
+  aggregate_cid TEXT NOT NULL REFERENCES cargo.aggregates ( aggregate_cid ),
+  client TEXT NOT NULL REFERENCES cargo.clients ( client ),
+  provider TEXT NOT NULL REFERENCES cargo.providers ( provider ),
+  status TEXT NOT NULL CONSTRAINT valid_verified_replica_status CHECK ( status IN ( 'allocated', 'claimed', 'expired', 'terminated' ) ),
+  term_min INTEGER NOT NULL CONSTRAINT valid_term_min CHECK ( term_min > 0 ),
+  term_max INTEGER NOT NULL CONSTRAINT valid_term_max CHECK ( term_max >= term_min ),
+  term_start INTEGER CONSTRAINT valid_term_start CHECK ( term_start > 0 ),
+  sector_number BIGINT CONSTRAINT valid_sector_number CHECK ( sector_number >= 0 ),
+  allocation_expiration INTEGER,
+  status_observed_epoch INTEGER NOT NULL,
+  entry_created TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  entry_last_updated TIMESTAMP WITH TIME ZONE NOT NULL
+);
+CREATE INDEX IF NOT EXISTS verified_replicas_aggregate_cid ON cargo.verified_replicas ( aggregate_cid );
+CREATE INDEX IF NOT EXISTS verified_replicas_provider ON cargo.verified_replicas ( provider );
+CREATE TRIGGER trigger_verified_replica_insert
+  BEFORE INSERT ON cargo.verified_replicas
+  FOR EACH ROW
+  EXECUTE PROCEDURE cargo.update_entry_timestamp()
+;
+CREATE TRIGGER trigger_verified_replica_updated
+  BEFORE UPDATE ON cargo.verified_replicas
+  FOR EACH ROW
+  WHEN (OLD IS DISTINCT FROM NEW)
+  EXECUTE PROCEDURE cargo.update_entry_timestamp()
+;
+
+-- live verified replicas of our own clients, that are not simply the claim behind one of our market deals
+-- these count toward replication just like own_deals do
+CREATE OR REPLACE VIEW cargo.own_direct_replicas AS (
+  SELECT vr.*
+    FROM cargo.verified_replicas vr
+    JOIN cargo.clients c USING ( client )
+  WHERE
+    vr.status IN ( 'allocated', 'claimed' )
+      AND
+    ( c.own OR NOT EXISTS ( SELECT 42 FROM cargo.clients WHERE own ) )
+      AND
+    NOT EXISTS (
+      SELECT 42
+        FROM cargo.deals d
+      WHERE d.aggregate_cid = vr.aggregate_cid AND d.provider = vr.provider AND d.client = vr.client
+    )
+);
+
+CREATE TABLE IF NOT EXISTS cargo.deal_proposals (
+  proposal_cid TEXT NOT NULL UNIQUE,
+  aggregate_cid TEXT NOT NULL REFERENCES cargo.aggregates ( aggregate_cid ),
+  client TEXT NOT NULL,
+  provider TEXT NOT NULL REFERENCES cargo.providers ( provider ),
+  start_epoch INTEGER NOT NULL CONSTRAINT valid_start CHECK ( start_epoch > 0 ),
+  end_epoch INTEGER NOT NULL CONSTRAINT valid_end CHECK ( end_epoch > start_epoch ),
+  verified BOOLEAN NOT NULL,
+  price_per_epoch NUMERIC NOT NULL,
+  entry_created TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS deal_proposals_aggregate_cid ON cargo.deal_proposals ( aggregate_cid );
+CREATE INDEX IF NOT EXISTS deal_proposals_provider ON cargo.deal_proposals ( provider );
+
+
+CREATE TABLE IF NOT EXISTS cargo.reservations (
+  reservation_id BIGSERIAL UNIQUE NOT NULL,
+  aggregate_cid TEXT NOT NULL REFERENCES cargo.aggregates ( aggregate_cid ),
+  provider TEXT NOT NULL REFERENCES cargo.providers ( provider ),
+  status TEXT NOT NULL CONSTRAINT valid_reservation_status CHECK ( status IN ( 'reserved', 'fulfilled', 'expired' ) ),
+  reserved_until TIMESTAMP WITH TIME ZONE NOT NULL,
+  deal_id BIGINT REFERENCES cargo.deals ( deal_id ),
+  allocation_id BIGINT REFERENCES cargo.verified_replicas ( allocation_id ),
+  request_id TEXT UNIQUE,
+  entry_created TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  entry_last_updated TIMESTAMP WITH TIME ZONE NOT NULL,
+  CONSTRAINT fulfilment_markers CHECK ( ( status = 'fulfilled' ) = ( deal_id IS NOT NULL OR allocation_id IS NOT NULL ) )
+);
+CREATE UNIQUE INDEX IF NOT EXISTS reservations_singleton_active ON cargo.reservations ( aggregate_cid, provider ) WHERE ( status = 'reserved' );
+CREATE INDEX IF NOT EXISTS reservations_provider ON cargo.reservations ( provider );
+CREATE TRIGGER trigger_reservation_insert
+  BEFORE INSERT ON cargo.reservations
+  FOR EACH ROW
+  EXECUTE PROCEDURE cargo.update_entry_timestamp()
+;
+CREATE TRIGGER trigger_reservation_updated
+  BEFORE UPDATE ON cargo.reservations
+  FOR EACH ROW
+  WHEN (OLD IS DISTINCT FROM NEW)
+  EXECUTE PROCEDURE cargo.update_entry_timestamp()
+;
+
+
+-- one row per probe-retrievals attempt: either a ranged HTTP piece fetch, or a trustless-gateway
+-- fetch of a random dag packaged in the deal's aggregate
+CREATE TABLE IF NOT EXISTS cargo.retrieval_probes (
+  probe_id BIGSERIAL UNIQUE NOT NULL,
+  deal_id BIGINT NOT NULL REFERENCES cargo.deals ( deal_id ),
+  provider TEXT NOT NULL REFERENCES cargo.providers ( provider ),
+  method TEXT NOT NULL CONSTRAINT valid_probe_method CHECK ( method IN ( 'piece', 'gateway' ) ),
+  target_cid TEXT NOT NULL,
+  url TEXT NOT NULL,
+  success BOOLEAN NOT NULL,
+  http_status INTEGER,
+  bytes_received BIGINT NOT NULL CONSTRAINT valid_bytes_received CHECK ( bytes_received >= 0 ),
+  ttfb_ms INTEGER CONSTRAINT valid_ttfb CHECK ( ttfb_ms >= 0 ),
+  duration_ms INTEGER NOT NULL CONSTRAINT valid_duration CHECK ( duration_ms >= 0 ),
+  error TEXT,
+  probed_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  CONSTRAINT probe_outcome CHECK ( success = ( error IS NULL ) )
+);
+CREATE INDEX IF NOT EXISTS retrieval_probes_provider_probed_at ON cargo.retrieval_probes ( provider, probed_at );
+CREATE INDEX IF NOT EXISTS retrieval_probes_deal_id ON cargo.retrieval_probes ( deal_id );
+
+-- observed_* is the lookback tipset track-deals saw the transition at
+-- chain_epoch is when the transition actually happened, where the chain tells us
+-- every event starts out tentative, and is later settled as either final or reverted
+-- once its observed_epoch is behind a tipset at finality
 CREATE TABLE IF NOT EXISTS cargo.deal_events (
   entry_id BIGSERIAL UNIQUE NOT NULL,
   deal_id BIGINT NOT NULL REFERENCES cargo.deals( deal_id ),
   status TEXT NOT NULL,
-  entry_created TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+  observed_epoch INTEGER NOT NULL,
+  observed_tipset_key TEXT[] NOT NULL,
+  chain_epoch INTEGER,
+  message_cid TEXT,
+  final BOOLEAN NOT NULL DEFAULT false,
+  reverted BOOLEAN NOT NULL DEFAULT false,
+  entry_created TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  entry_settled TIMESTAMP WITH TIME ZONE,
+  CONSTRAINT settled_once CHECK ( NOT ( final AND reverted ) ),
+  CONSTRAINT settled_at CHECK ( ( final OR reverted ) = ( entry_settled IS NOT NULL ) )
 );
 CREATE INDEX IF NOT EXISTS deal_events_deal_id ON cargo.deal_events ( deal_id );
+CREATE INDEX IF NOT EXISTS deal_events_tentative ON cargo.deal_events ( observed_epoch ) WHERE ( NOT final AND NOT reverted );
+
+CREATE TRIGGER trigger_deal_event_webhooks
+  AFTER UPDATE OF final ON cargo.deal_events
+  FOR EACH ROW
+  WHEN (NEW.final AND NOT OLD.final AND NEW.status IN ( 'published', 'active', 'expiring' ))
+  EXECUTE PROCEDURE cargo.enqueue_deal_webhooks()
+;
+
+-- transitions confirmed by a tipset at or past finality: what downstream consumers should follow
+CREATE OR REPLACE VIEW cargo.final_deal_events AS (
+  SELECT *
+    FROM cargo.deal_events
+  WHERE final
+);
+
+
+-- projects with a webhook-endpoint, kept in line with the config by every dispatch-webhooks run
+CREATE TABLE IF NOT EXISTS cargo.webhook_subscriptions (
+  project INTEGER NOT NULL UNIQUE,
+  entry_created TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+-- filled by triggers, drained by dispatch-webhooks
+-- only subscribed projects get events: the ones with a webhook-endpoint as of the last dispatch-webhooks run
+CREATE TABLE IF NOT EXISTS cargo.webhook_outbox (
+  event_id BIGSERIAL UNIQUE NOT NULL,
+  project INTEGER NOT NULL,
+  cid_v1 TEXT NOT NULL REFERENCES cargo.dags ( cid_v1 ),
+  milestone TEXT NOT NULL CONSTRAINT valid_milestone CHECK ( milestone IN ( 'analyzed', 'aggregated', 'deal_published', 'deal_active' ) ),
+  payload JSONB NOT NULL,
+  status TEXT NOT NULL DEFAULT 'pending' CONSTRAINT valid_delivery_status CHECK ( status IN ( 'pending', 'delivered', 'dead' ) ),
+  attempts INTEGER NOT NULL DEFAULT 0,
+  next_attempt_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  last_error TEXT,
+  entry_created TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  entry_delivered TIMESTAMP WITH TIME ZONE,
+  CONSTRAINT singleton_milestone UNIQUE ( project, cid_v1, milestone ),
+  CONSTRAINT delivery_markers CHECK ( ( status = 'delivered' ) = ( entry_delivered IS NOT NULL ) )
+);
+CREATE INDEX IF NOT EXISTS webhook_outbox_pending ON cargo.webhook_outbox ( project, event_id ) WHERE ( status = 'pending' );
+CREATE INDEX IF NOT EXISTS webhook_outbox_pending_cid ON cargo.webhook_outbox ( project, cid_v1, event_id ) WHERE ( status = 'pending' );
+CREATE INDEX IF NOT EXISTS webhook_outbox_delivered ON cargo.webhook_outbox ( entry_delivered ) WHERE ( status = 'delivered' );
+
+
+CREATE TABLE IF NOT EXISTS cargo.runtime_state (
+  state_key TEXT NOT NULL UNIQUE,
+  state JSONB NOT NULL,
+  entry_last_updated TIMESTAMP WITH TIME ZONE NOT NULL
+);
+CREATE TRIGGER trigger_runtime_state_insert
+  BEFORE INSERT ON cargo.runtime_state
+  FOR EACH ROW
+  EXECUTE PROCEDURE cargo.update_entry_timestamp()
+;
+CREATE TRIGGER trigger_runtime_state_updated
+  BEFORE UPDATE ON cargo.runtime_state
+  FOR EACH ROW
+  WHEN (OLD IS DISTINCT FROM NEW)
+  EXECUTE PROCEDURE cargo.update_entry_timestamp()
+;
 
 
 CREATE TABLE IF NOT EXISTS cargo.metrics (
@@ -232,13 +590,22 @@ CREATE OR REPLACE VIEW cargo.aggregate_summary AS (
       JOIN cargo.sources s USING ( srcid )
     WHERE NOT EXISTS (
       SELECT 42
-        FROM cargo.aggregate_entries ae2, cargo.deals de
+        FROM cargo.aggregate_entries ae2, cargo.own_deals de
       WHERE
         ae.cid_v1 = ae2.cid_v1
           AND
         ae2.aggregate_cid = de.aggregate_cid
           AND
-        de.status != 'terminated'
+        de.status NOT IN ( 'terminated', 'expired', 'slashed', 'invalid' )
+    )
+      AND
+    NOT EXISTS (
+      SELECT 42
+        FROM cargo.aggregate_entries ae2, cargo.own_direct_replicas vr
+      WHERE
+        ae.cid_v1 = ae2.cid_v1
+          AND
+        ae2.aggregate_cid = vr.aggregate_cid
     )
     GROUP BY ae.aggregate_cid, s.project
   )
@@ -246,9 +613,14 @@ CREATE OR REPLACE VIEW cargo.aggregate_summary AS (
     a.aggregate_cid,
     a.piece_cid,
     a.export_size AS car_size,
+    a.piece_size,
     a.entry_created AS aggregated_at,
     'https://app-cargo.fil.riba.cloud/deal-cars/' || (metadata->>'md5hex') || '_' || piece_cid || '.car' AS http_source,
-    ( SELECT COUNT(*) FROM cargo.deals d WHERE a.aggregate_cid = d.aggregate_cid AND d.status != 'terminated' ) AS tentative_replicas,
+    (
+      ( SELECT COUNT(*) FROM cargo.own_deals d WHERE a.aggregate_cid = d.aggregate_cid AND d.status NOT IN ( 'terminated', 'expired', 'slashed', 'invalid' ) )
+        +
+      ( SELECT COUNT(*) FROM cargo.own_direct_replicas vr WHERE a.aggregate_cid = vr.aggregate_cid )
+    ) AS tentative_replicas,
     (
       SELECT JSONB_OBJECT_AGG( k,v ) FROM (
 
@@ -268,14 +640,32 @@ CREATE OR REPLACE VIEW cargo.aggregate_summary AS (
       SELECT JSONB_OBJECT_AGG( k,v ) FROM (
 
           SELECT 'pending' AS k, JSONB_BUILD_OBJECT( 'any_region', COUNT(*) ) AS v
-            FROM cargo.deals de
+            FROM cargo.own_deals de
           WHERE de.status = 'published' AND de.aggregate_cid = a.aggregate_cid
 
         UNION ALL
 
           SELECT 'active' AS k, JSONB_BUILD_OBJECT( 'any_region', COUNT(*) ) AS v
-            FROM cargo.deals de
-          WHERE de.status = 'active' AND de.aggregate_cid = a.aggregate_cid
+            FROM cargo.own_deals de
+          WHERE de.status IN ( 'active', 'expiring' ) AND de.aggregate_cid = a.aggregate_cid
+
+        UNION ALL
+
+          SELECT 'expiring' AS k, JSONB_BUILD_OBJECT( 'any_region', COUNT(*) ) AS v
+            FROM cargo.own_deals de
+          WHERE de.status = 'expiring' AND de.aggregate_cid = a.aggregate_cid
+
+        UNION ALL
+
+          SELECT 'direct' AS k, JSONB_BUILD_OBJECT( 'any_region', COUNT(*) ) AS v
+            FROM cargo.own_direct_replicas vr
+          WHERE vr.aggregate_cid = a.aggregate_cid
+
+        UNION ALL
+
+          SELECT 'foreign' AS k, JSONB_BUILD_OBJECT( 'any_region', COUNT(*) ) AS v
+            FROM cargo.foreign_deals de
+          WHERE de.status NOT IN ( 'terminated', 'expired', 'slashed', 'invalid' ) AND de.aggregate_cid = a.aggregate_cid
 
       ) j
     ) AS replica_counts
@@ -290,6 +680,219 @@ CREATE OR REPLACE VIEW cargo.aggregate_summary AS (
     ( SELECT COUNT(*) FROM cargo.aggregate_entries ae WHERE a.aggregate_cid = ae.aggregate_cid ) DESC NULLS LAST
 );
 
+-- aggregates with live content, whose replicas not expiring within the horizon are below target
+CREATE OR REPLACE
+  FUNCTION cargo.renewal_queue(target_replicas INTEGER, horizon INTERVAL) RETURNS TABLE (
+    aggregate_cid TEXT,
+    piece_cid TEXT,
+    lasting_replicas BIGINT,
+    expiring_replicas BIGINT,
+    earliest_expiration TIMESTAMP WITH TIME ZONE
+  )
+    LANGUAGE sql STABLE
+AS $$
+  WITH
+  -- a direct replica is only guaranteed for its minimum term, and not yet started while merely allocated
+  replicas AS (
+    SELECT d.aggregate_cid, d.status = 'expiring' AS expiring, d.end_time
+      FROM cargo.own_deals d
+    WHERE d.status NOT IN ( 'terminated', 'expired', 'slashed', 'invalid' )
+
+      UNION ALL
+
+    SELECT vr.aggregate_cid, false AS expiring, cargo.epoch_to_timestamp( vr.term_start + vr.term_min ) AS end_time
+      FROM cargo.own_direct_replicas vr
+  )
+  SELECT
+      a.aggregate_cid,
+      a.piece_cid,
+      COUNT(*) FILTER ( WHERE NOT r.expiring AND ( r.end_time IS NULL OR r.end_time > NOW() + horizon ) ) AS lasting_replicas,
+      COUNT(*) FILTER ( WHERE r.expiring OR r.end_time <= NOW() + horizon ) AS expiring_replicas,
+      MIN( r.end_time ) FILTER ( WHERE r.expiring OR r.end_time <= NOW() + horizon ) AS earliest_expiration
+    FROM cargo.aggregates a
+    JOIN replicas r USING ( aggregate_cid )
+  WHERE
+    EXISTS (
+      SELECT 42
+        FROM cargo.aggregate_entries ae
+        JOIN cargo.dag_sources ds USING ( cid_v1 )
+      WHERE ae.aggregate_cid = a.aggregate_cid AND ds.entry_removed IS NULL
+    )
+  GROUP BY a.aggregate_cid, a.piece_cid
+  HAVING
+    COUNT(*) FILTER ( WHERE r.expiring OR r.end_time <= NOW() + horizon ) > 0
+      AND
+    COUNT(*) FILTER ( WHERE NOT r.expiring AND ( r.end_time IS NULL OR r.end_time > NOW() + horizon ) ) < target_replicas
+  ORDER BY earliest_expiration, a.aggregate_cid
+$$;
+
+-- burn rate of our own clients over the past week, and when at that rate their DataCap runs out
+-- replicas_remaining is how many more aggregates of the size made over the past month it covers
+CREATE OR REPLACE VIEW cargo.client_datacap_projection AS (
+  WITH
+  window_start AS (
+    SELECT DISTINCT ON ( client ) client, filp_available, recorded_at
+      FROM cargo.client_datacap_log
+    WHERE recorded_at > NOW() - '7 days'::INTERVAL
+    ORDER BY client, recorded_at
+  ),
+  latest AS (
+    SELECT DISTINCT ON ( client ) client, filp_available, recorded_at
+      FROM cargo.client_datacap_log
+    ORDER BY client, recorded_at DESC
+  ),
+  burn AS (
+    SELECT
+        l.client,
+        l.filp_available,
+        l.recorded_at AS last_reading,
+        ( w.filp_available - l.filp_available ) / NULLIF( EXTRACT( EPOCH FROM l.recorded_at - w.recorded_at ) / 86400, 0 ) AS bytes_per_day
+      FROM latest l
+      LEFT JOIN window_start w USING ( client )
+  ),
+  recent_pieces AS (
+    SELECT AVG( piece_size ) AS avg_piece_size
+      FROM cargo.aggregates
+    WHERE entry_created > NOW() - '30 days'::INTERVAL
+  )
+  SELECT
+      b.client,
+      b.filp_available,
+      b.last_reading,
+      -- a top-up within the window shows up as negative burn
+      GREATEST( b.bytes_per_day, 0 )::BIGINT AS burn_bytes_per_day,
+      CASE WHEN b.bytes_per_day > 0 THEN b.last_reading + ( b.filp_available / b.bytes_per_day ) * '1 day'::INTERVAL END AS projected_exhaustion,
+      FLOOR( b.filp_available / rp.avg_piece_size )::BIGINT AS replicas_remaining
+    FROM burn b
+    JOIN cargo.clients c USING ( client )
+    CROSS JOIN recent_pieces rp
+  WHERE c.own
+);
+
+-- FIL committed by our own clients: the full-term price of every valid deal, whether or not it ran to completion
+-- all amounts are in attoFIL, deals with unknown amounts are left out of the sums
+CREATE OR REPLACE VIEW cargo.deal_costs AS (
+  SELECT
+      deal_id,
+      aggregate_cid,
+      provider,
+      client,
+      status,
+      price_per_epoch * ( end_epoch - start_epoch ) AS total_price,
+      provider_collateral,
+      client_collateral
+    FROM cargo.own_deals
+  WHERE status != 'invalid'
+);
+
+CREATE OR REPLACE VIEW cargo.aggregate_costs AS (
+  SELECT
+      aggregate_cid,
+      COUNT(*) AS deals,
+      SUM( total_price ) AS total_price,
+      SUM( provider_collateral ) AS provider_collateral,
+      SUM( client_collateral ) AS client_collateral
+    FROM cargo.deal_costs
+  GROUP BY aggregate_cid
+);
+
+CREATE OR REPLACE VIEW cargo.provider_costs AS (
+  SELECT
+      provider,
+      COUNT(*) AS deals,
+      SUM( total_price ) AS total_price,
+      SUM( provider_collateral ) AS provider_collateral,
+      SUM( client_collateral ) AS client_collateral
+    FROM cargo.deal_costs
+  GROUP BY provider
+);
+
+-- an aggregate's cost is split between projects by the bytes of the member DAGs each of them stored
+-- a DAG stored by several projects counts fully toward each one, shares are normalized per aggregate
+CREATE OR REPLACE VIEW cargo.project_costs AS (
+  WITH
+  project_bytes AS (
+    SELECT ae.aggregate_cid, s.project, SUM( d.size_actual ) AS bytes
+      FROM cargo.aggregate_entries ae
+      JOIN cargo.dags d USING ( cid_v1 )
+      JOIN (
+        SELECT DISTINCT ds.cid_v1, s.project
+          FROM cargo.dag_sources ds
+          JOIN cargo.sources s USING ( srcid )
+      ) s USING ( cid_v1 )
+    GROUP BY ae.aggregate_cid, s.project
+  ),
+  project_shares AS (
+    SELECT aggregate_cid, project, bytes::NUMERIC / NULLIF( SUM( bytes ) OVER ( PARTITION BY aggregate_cid ), 0 ) AS share
+      FROM project_bytes
+  )
+  SELECT
+      ps.project,
+      COUNT( DISTINCT ac.aggregate_cid ) AS aggregates,
+      ROUND( SUM( ac.total_price * ps.share ) ) AS total_price,
+      ROUND( SUM( ac.provider_collateral * ps.share ) ) AS provider_collateral,
+      ROUND( SUM( ac.client_collateral * ps.share ) ) AS client_collateral
+    FROM cargo.aggregate_costs ac
+    JOIN project_shares ps USING ( aggregate_cid )
+  GROUP BY ps.project
+);
+
+-- per-provider track record, copied into providers.details->'scorecard' by track-deals
+-- a deal "missed start" if it was retired without its sector ever activating
+-- publish-to-activation comes from chain epochs where the publish message is known, otherwise
+-- from when a deal was first observed, which is only meaningful if it was still published then
+CREATE OR REPLACE VIEW cargo.provider_scorecard AS (
+  WITH
+  first_seen AS (
+    SELECT DISTINCT ON ( deal_id ) deal_id, status, entry_created
+      FROM cargo.deal_events
+    WHERE NOT reverted
+    ORDER BY deal_id, entry_id
+  ),
+  per_provider AS (
+    SELECT
+        d.provider,
+        COUNT(*) AS deals_published,
+        COUNT(*) FILTER ( WHERE d.sector_start_epoch IS NOT NULL ) AS deals_activated,
+        COUNT(*) FILTER ( WHERE d.status IN ( 'terminated', 'slashed' ) ) AS deals_terminated,
+        COUNT(*) FILTER ( WHERE d.sector_start_epoch IS NULL AND d.status IN ( 'terminated', 'expired', 'slashed' ) ) AS deals_missed_start,
+        PERCENTILE_CONT(0.5) WITHIN GROUP ( ORDER BY
+          COALESCE(
+            EXTRACT( EPOCH FROM d.sector_start_time - cargo.epoch_to_timestamp( d.publish_epoch ) ),
+            GREATEST( 0, EXTRACT( EPOCH FROM d.sector_start_time - fs.entry_created ) )
+          )
+        ) FILTER ( WHERE ( d.publish_epoch IS NOT NULL OR fs.status = 'published' ) AND d.sector_start_time IS NOT NULL ) AS median_seconds_publish_to_active
+      FROM cargo.deals d
+      LEFT JOIN first_seen fs USING ( deal_id )
+    GROUP BY d.provider
+  )
+  SELECT
+      provider,
+      deals_published,
+      deals_activated,
+      deals_terminated,
+      deals_missed_start,
+      ROUND( deals_missed_start::NUMERIC / NULLIF( deals_activated + deals_missed_start, 0 ), 4 ) AS missed_start_ratio,
+      median_seconds_publish_to_active::BIGINT
+    FROM per_provider
+);
+
+-- retrieval track record over the past week, copied into providers.details->'retrieval' by probe-retrievals
+CREATE OR REPLACE VIEW cargo.provider_retrieval_summary AS (
+  SELECT
+      provider,
+      COUNT(*) AS probes,
+      COUNT(*) FILTER ( WHERE success ) AS successes,
+      ROUND( ( COUNT(*) FILTER ( WHERE success ) )::NUMERIC / COUNT(*), 4 ) AS success_ratio,
+      ( PERCENTILE_CONT(0.5) WITHIN GROUP ( ORDER BY ttfb_ms ) FILTER ( WHERE success ) )::INTEGER AS median_ttfb_ms,
+      ( PERCENTILE_CONT(0.5) WITHIN GROUP ( ORDER BY duration_ms ) FILTER ( WHERE success ) )::INTEGER AS median_duration_ms,
+      MAX( probed_at ) AS last_probed_at,
+      MAX( probed_at ) FILTER ( WHERE success ) AS last_success_at
+    FROM cargo.retrieval_probes
+  WHERE probed_at > NOW() - '7 days'::INTERVAL
+  GROUP BY provider
+);
+
 CREATE OR REPLACE VIEW cargo.dags_missing_list AS (
 
   SELECT m.*, s.project, COALESCE( s.weight, 100 ) AS weight
@@ -0,0 +1,149 @@
+-- Brings a database created from an earlier pg_schema.sql up to date with
+-- the column changes CREATE TABLE IF NOT EXISTS can not apply by itself.
+-- Every statement is safe to repeat. Run it first, then re-apply pg_schema.sql
+-- for the new tables, functions, views and triggers:
+--
+--   psql -v ON_ERROR_STOP=1 -1 -f maint/pg_upgrade.sql
+--   psql -f maint/pg_schema.sql
+--
+-- Requires PostgreSQL 13 or later ( DROP EXPRESSION ).
+
+--
+-- views: several gained columns in the middle, which CREATE OR REPLACE VIEW
+-- refuses, and others depend on column types changed below. All of them are
+-- recreated by pg_schema.sql.
+--
+DO $$
+DECLARE
+  v TEXT;
+BEGIN
+  FOR v IN SELECT table_name FROM information_schema.views WHERE table_schema = 'cargo' LOOP
+    EXECUTE FORMAT( 'DROP VIEW IF EXISTS cargo.%I CASCADE', v );
+  END LOOP;
+END;
+$$;
+
+--
+-- network parameters: the backfills below read them, before pg_schema.sql would
+-- create the table. Left empty it stands for mainnet until the next lotus connection.
+--
+CREATE TABLE IF NOT EXISTS cargo.network_params (
+  singleton BOOLEAN NOT NULL UNIQUE DEFAULT true CONSTRAINT single_row CHECK ( singleton ),
+  network_name TEXT NOT NULL,
+  genesis_unix BIGINT NOT NULL,
+  block_delay_seconds INTEGER NOT NULL CONSTRAINT valid_block_delay CHECK ( block_delay_seconds > 0 )
+);
+
+--
+-- deal sectors: slashing and sector checks, unknown until the next track-deals
+--
+ALTER TABLE cargo.deals ADD COLUMN IF NOT EXISTS slash_epoch INTEGER CONSTRAINT valid_slash CHECK ( slash_epoch > 0 );
+ALTER TABLE cargo.deals ADD COLUMN IF NOT EXISTS sector_number BIGINT CONSTRAINT valid_sector_number CHECK ( sector_number >= 0 );
+ALTER TABLE cargo.deals ADD COLUMN IF NOT EXISTS sector_expiration_epoch INTEGER CONSTRAINT valid_sector_expiration CHECK ( sector_expiration_epoch > 0 );
+ALTER TABLE cargo.deals ADD COLUMN IF NOT EXISTS sector_state TEXT CONSTRAINT valid_sector_state CHECK ( sector_state IN ( 'healthy', 'faulty', 'terminated' ) );
+-- slashing and sector state changes bump entry_last_updated: pg_schema.sql
+-- recreates the trigger with the wider condition
+DROP TRIGGER IF EXISTS trigger_deal_updated ON cargo.deals;
+
+--
+-- deal times: formerly mainnet-only generated columns, now filled by
+-- trigger_deal_times from cargo.network_params. Dropping the expression keeps
+-- the values already computed.
+--
+DO $$
+DECLARE
+  col TEXT;
+BEGIN
+  FOREACH col IN ARRAY ARRAY[ 'start_time', 'end_time', 'sector_start_time' ] LOOP
+    IF EXISTS (
+      SELECT 42
+        FROM information_schema.columns
+      WHERE table_schema = 'cargo' AND table_name = 'deals' AND column_name = col AND is_generated = 'ALWAYS'
+    ) THEN
+      EXECUTE FORMAT( 'ALTER TABLE cargo.deals ALTER COLUMN %I DROP EXPRESSION', col );
+    END IF;
+  END LOOP;
+END;
+$$;
+
+--
+-- own clients and their DataCap: BIGINT could not hold every allowance,
+-- amounts are NUMERIC like the deal prices
+--
+ALTER TABLE cargo.clients ADD COLUMN IF NOT EXISTS own BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE cargo.clients ALTER COLUMN filp_available TYPE NUMERIC;
+
+--
+-- aggregates.piece_size: recorded at aggregation time from now on, derived
+-- from the car size for existing aggregates the same way the views used to
+--
+ALTER TABLE cargo.aggregates ADD COLUMN IF NOT EXISTS piece_size BIGINT;
+UPDATE cargo.aggregates
+  SET piece_size = GREATEST( 128, POW( 2, CEIL( LOG( 2, export_size * 128.0 / 127 ) ) ) )::BIGINT
+WHERE piece_size IS NULL;
+ALTER TABLE cargo.aggregates ALTER COLUMN piece_size SET NOT NULL;
+ALTER TABLE cargo.aggregates DROP CONSTRAINT IF EXISTS valid_piece_size;
+ALTER TABLE cargo.aggregates ADD CONSTRAINT valid_piece_size CHECK ( piece_size >= 128 AND ( piece_size & ( piece_size - 1 ) ) = 0 );
+
+--
+-- deal observations: rows from before this was tracked get the epoch of their
+-- last change ( mainnet unless cargo.network_params says otherwise ) and an
+-- empty tipset key, as the actual tipset is not known
+--
+ALTER TABLE cargo.deals ADD COLUMN IF NOT EXISTS publish_message_cid TEXT;
+ALTER TABLE cargo.deals ADD COLUMN IF NOT EXISTS publish_epoch INTEGER CONSTRAINT valid_publish_epoch CHECK ( publish_epoch > 0 );
+ALTER TABLE cargo.deals ADD COLUMN IF NOT EXISTS status_observed_epoch INTEGER;
+ALTER TABLE cargo.deals ADD COLUMN IF NOT EXISTS status_observed_tipset_key TEXT[];
+UPDATE cargo.deals SET
+  status_observed_epoch = (
+    EXTRACT( EPOCH FROM entry_last_updated )::BIGINT - COALESCE( ( SELECT genesis_unix FROM cargo.network_params ), 1598306400 )
+  ) / COALESCE( ( SELECT block_delay_seconds FROM cargo.network_params ), 30 ),
+  status_observed_tipset_key = '{}'
+WHERE status_observed_epoch IS NULL;
+ALTER TABLE cargo.deals ALTER COLUMN status_observed_epoch SET NOT NULL;
+ALTER TABLE cargo.deals ALTER COLUMN status_observed_tipset_key SET NOT NULL;
+
+ALTER TABLE cargo.deal_events ADD COLUMN IF NOT EXISTS observed_epoch INTEGER;
+ALTER TABLE cargo.deal_events ADD COLUMN IF NOT EXISTS observed_tipset_key TEXT[];
+ALTER TABLE cargo.deal_events ADD COLUMN IF NOT EXISTS chain_epoch INTEGER;
+ALTER TABLE cargo.deal_events ADD COLUMN IF NOT EXISTS message_cid TEXT;
+UPDATE cargo.deal_events SET
+  observed_epoch = (
+    EXTRACT( EPOCH FROM entry_created )::BIGINT - COALESCE( ( SELECT genesis_unix FROM cargo.network_params ), 1598306400 )
+  ) / COALESCE( ( SELECT block_delay_seconds FROM cargo.network_params ), 30 ),
+  observed_tipset_key = '{}'
+WHERE observed_epoch IS NULL;
+ALTER TABLE cargo.deal_events ALTER COLUMN observed_epoch SET NOT NULL;
+ALTER TABLE cargo.deal_events ALTER COLUMN observed_tipset_key SET NOT NULL;
+
+--
+-- deal proposal details: not recoverable here. The next full scan
+-- ( track-deals --full-scan ) fills them for every deal still in the market
+-- state, the rest stay NULL.
+--
+ALTER TABLE cargo.deals ADD COLUMN IF NOT EXISTS verified BOOLEAN;
+ALTER TABLE cargo.deals ADD COLUMN IF NOT EXISTS label TEXT;
+ALTER TABLE cargo.deals ADD COLUMN IF NOT EXISTS price_per_epoch NUMERIC CONSTRAINT valid_price CHECK ( price_per_epoch >= 0 );
+ALTER TABLE cargo.deals ADD COLUMN IF NOT EXISTS provider_collateral NUMERIC CONSTRAINT valid_provider_collateral CHECK ( provider_collateral >= 0 );
+ALTER TABLE cargo.deals ADD COLUMN IF NOT EXISTS client_collateral NUMERIC CONSTRAINT valid_client_collateral CHECK ( client_collateral >= 0 );
+
+--
+-- deal event settlement: events recorded before this existed are long past
+-- finality, and are settled as final rather than re-checked one by one
+--
+DO $$
+BEGIN
+  IF NOT EXISTS (
+    SELECT 42
+      FROM information_schema.columns
+    WHERE table_schema = 'cargo' AND table_name = 'deal_events' AND column_name = 'final'
+  ) THEN
+    ALTER TABLE cargo.deal_events ADD COLUMN final BOOLEAN NOT NULL DEFAULT false;
+    ALTER TABLE cargo.deal_events ADD COLUMN reverted BOOLEAN NOT NULL DEFAULT false;
+    ALTER TABLE cargo.deal_events ADD COLUMN entry_settled TIMESTAMP WITH TIME ZONE;
+    UPDATE cargo.deal_events SET final = true, entry_settled = NOW();
+    ALTER TABLE cargo.deal_events ADD CONSTRAINT settled_once CHECK ( NOT ( final AND reverted ) );
+    ALTER TABLE cargo.deal_events ADD CONSTRAINT settled_at CHECK ( ( final OR reverted ) = ( entry_settled IS NOT NULL ) );
+  END IF;
+END;
+$$;
@@ -0,0 +1,19 @@
+-- The table push-deal-info upserts into, one per project, in the database
+-- behind its deal-info connection string ( see pgProjects in cmd/cron/importpg.go ).
+-- Apply it there before adding the project to the push-deal-info cron entry:
+--
+--   psql -v ON_ERROR_STOP=1 "service=web3-storage-rw" -f maint/pg_upstream_deal_info.sql
+--
+CREATE TABLE IF NOT EXISTS public.cargo_deal_info (
+  content_cid TEXT NOT NULL,
+  aggregate_cid TEXT NOT NULL,
+  piece_cid TEXT NOT NULL,
+  deal_id BIGINT NOT NULL,
+  provider TEXT NOT NULL,
+  status TEXT NOT NULL,
+  deal_start TIMESTAMP WITH TIME ZONE NOT NULL,
+  deal_end TIMESTAMP WITH TIME ZONE NOT NULL,
+  updated_at TIMESTAMP WITH TIME ZONE NOT NULL,
+  CONSTRAINT singleton_content_deal UNIQUE ( content_cid, deal_id )
+);
+CREATE INDEX IF NOT EXISTS cargo_deal_info_updated_at ON public.cargo_deal_info ( updated_at );